@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultApprovalLog = "config/approvals.jsonl"
+
+// Approval modes
+const (
+	approvalModeBot  = "bot"
+	approvalModeHTTP = "http"
+)
+
+// Review decisions
+const (
+	decisionApproved     = "approved"
+	decisionEdited       = "edited"
+	decisionRejected     = "rejected"
+	decisionAutoApproved = "auto-approved"
+	decisionAutoRejected = "auto-rejected"
+	decisionBypassed     = "bypassed"
+	decisionSuperseded   = "superseded"
+)
+
+// ApprovalPolicy configures review before publishing. An empty Mode disables it.
+type ApprovalPolicy struct {
+	// Mode is "bot" for a review chat with inline buttons or "http" for a local endpoint
+	Mode string
+	// Timeout is how long a post waits for review; TimeoutApprove publishes it afterwards
+	Timeout        time.Duration
+	TimeoutApprove bool
+	// DangerBypass publishes danger posts without review
+	DangerBypass bool
+	// BotToken and ChatID address the review chat through the Bot API
+	BotToken string
+	ChatID   string
+	// Addr is the listen address of the HTTP endpoint
+	Addr string
+	// LogPath is the JSONL decision log, empty to disable it
+	LogPath string
+}
+
+func loadApprovalPolicy() ApprovalPolicy {
+	policy := ApprovalPolicy{
+		Mode:           strings.ToLower(getEnv("APPROVAL_MODE", "")),
+		Timeout:        envDuration("APPROVAL_TIMEOUT", 3*time.Minute),
+		TimeoutApprove: getEnv("APPROVAL_TIMEOUT_ACTION", "approve") != "reject",
+		DangerBypass:   getEnv("APPROVAL_DANGER_BYPASS", "true") == "true",
+		BotToken:       getEnv("APPROVAL_BOT_TOKEN", ""),
+		ChatID:         getEnv("APPROVAL_CHAT_ID", ""),
+		Addr:           getEnv("APPROVAL_ADDR", "127.0.0.1:8087"),
+		LogPath:        getEnv("APPROVAL_LOG", defaultApprovalLog),
+	}
+	switch policy.Mode {
+	case "", "off", "none":
+		policy.Mode = ""
+	case approvalModeBot:
+		if policy.BotToken == "" || policy.ChatID == "" {
+			log.Printf("APPROVAL_MODE=bot needs APPROVAL_BOT_TOKEN and APPROVAL_CHAT_ID, review disabled")
+			policy.Mode = ""
+		}
+	case approvalModeHTTP:
+	default:
+		log.Printf("Unknown APPROVAL_MODE '%s', review disabled", policy.Mode)
+		policy.Mode = ""
+	}
+	return policy
+}
+
+// ApprovalDecision is one entry of the decision log. Original and Text differ
+// when the reviewer edited the post, so the log doubles as labeled data. A post
+// that goes out is logged once it was published, with the sinks that published
+// it; exchange records join the log through their ReviewID.
+type ApprovalDecision struct {
+	ID       string          `json:"id"`
+	Time     time.Time       `json:"time"`
+	Decision string          `json:"decision"`
+	Reviewer string          `json:"reviewer,omitempty"`
+	Waited   float64         `json:"waitedSeconds"`
+	Danger   bool            `json:"danger"`
+	Original string          `json:"original"`
+	Text     string          `json:"text,omitempty"`
+	Response *AIJSONResponse `json:"response,omitempty"`
+	// PublishedTo lists the sinks that published an approved post
+	PublishedTo []string `json:"publishedTo,omitempty"`
+}
+
+// pendingPost is a post waiting for review.
+type pendingPost struct {
+	ID      string
+	Post    Post
+	Created time.Time
+	publish func(Post) []string
+	// withheld is called when the post is rejected, so the model learns it was not published
+	withheld func(Post, string)
+	timer    *time.Timer
+	// reviewMessageID is the review chat message of the post in bot mode
+	reviewMessageID int
+}
+
+// reviewer shows pending posts to a human and reports decisions back through Approver.decide.
+type reviewer interface {
+	start(ctx context.Context)
+	request(ctx context.Context, pending *pendingPost) error
+	resolved(ctx context.Context, pending *pendingPost, decision ApprovalDecision)
+}
+
+// Approver holds posts for review before they are published. A nil approver
+// publishes everything directly.
+type Approver struct {
+	policy   ApprovalPolicy
+	reviewer reviewer
+
+	mu      sync.Mutex
+	pending map[string]*pendingPost
+	logMu   sync.Mutex
+}
+
+// newApprover returns nil when review is disabled.
+func newApprover(policy ApprovalPolicy) *Approver {
+	if policy.Mode == "" {
+		return nil
+	}
+	a := &Approver{policy: policy, pending: make(map[string]*pendingPost)}
+	switch policy.Mode {
+	case approvalModeBot:
+		a.reviewer = newBotReviewer(a)
+	case approvalModeHTTP:
+		a.reviewer = &httpReviewer{approver: a}
+	}
+	log.Printf("Approval mode %s: timeout %v (approve afterwards %v), danger bypass %v",
+		policy.Mode, policy.Timeout, policy.TimeoutApprove, policy.DangerBypass)
+	return a
+}
+
+// Start runs the reviewer until ctx is done.
+func (a *Approver) Start(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	go a.reviewer.start(ctx)
+}
+
+// Required reports whether the post must be reviewed. A danger post that may
+// bypass review is logged as bypassed.
+func (a *Approver) Required(post Post) bool {
+	if a == nil {
+		return false
+	}
+	if post.Danger && a.policy.DangerBypass {
+		a.record(ApprovalDecision{ID: newReviewID(), Time: time.Now(), Decision: decisionBypassed, Danger: true, Original: post.Text, Text: post.Text, Response: &post.Response})
+		return false
+	}
+	return true
+}
+
+// Submit queues the post for review and returns its ID; publish is called once
+// it is approved and returns the sinks that published it, withheld once it is
+// rejected. A post still waiting is superseded by the new one, so a late approval
+// never publishes an outdated status.
+func (a *Approver) Submit(ctx context.Context, post Post, publish func(Post) []string, withheld func(Post, string)) string {
+	pending := &pendingPost{ID: newReviewID(), Post: post, Created: time.Now(), publish: publish, withheld: withheld}
+
+	a.mu.Lock()
+	var superseded []string
+	for id := range a.pending {
+		superseded = append(superseded, id)
+	}
+	pending.timer = time.AfterFunc(a.policy.Timeout, func() {
+		a.decide(ctx, pending.ID, a.timeoutDecision(), "", "")
+	})
+	a.pending[pending.ID] = pending
+	a.mu.Unlock()
+	for _, id := range superseded {
+		a.decide(ctx, id, decisionSuperseded, "", "")
+	}
+
+	log.Printf("Post %s waiting for review", pending.ID)
+	if err := a.reviewer.request(ctx, pending); err != nil {
+		// An unreachable review chat must not hold back posts, decide as on timeout
+		log.Printf("Error requesting review of post %s: %v", pending.ID, err)
+		a.decide(ctx, pending.ID, a.timeoutDecision(), "", "")
+	}
+	return pending.ID
+}
+
+// timeoutDecision is the decision for posts nobody reviewed in time.
+func (a *Approver) timeoutDecision() string {
+	if a.policy.TimeoutApprove {
+		return decisionAutoApproved
+	}
+	return decisionAutoRejected
+}
+
+// decide resolves a pending post. text replaces the AI text for edits. It
+// reports false when the post is no longer pending.
+func (a *Approver) decide(ctx context.Context, id, decision, text, reviewer string) bool {
+	a.mu.Lock()
+	pending, ok := a.pending[id]
+	if ok {
+		delete(a.pending, id)
+	}
+	a.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+
+	post := pending.Post
+	if decision == decisionEdited {
+		post.Response.Text = strings.TrimSpace(text)
+		post.Text = formatAIResponse(post.Response)
+	}
+	entry := ApprovalDecision{
+		ID:       id,
+		Time:     time.Now(),
+		Decision: decision,
+		Reviewer: reviewer,
+		Waited:   time.Since(pending.Created).Seconds(),
+		Danger:   post.Danger,
+		Original: pending.Post.Text,
+		Response: &pending.Post.Response,
+	}
+	if reviewer != "" {
+		log.Printf("Post %s %s by %s", id, decision, reviewer)
+	} else {
+		log.Printf("Post %s %s", id, decision)
+	}
+	switch decision {
+	case decisionApproved, decisionEdited, decisionAutoApproved:
+		entry.Text = post.Text
+		go func(entry ApprovalDecision) {
+			entry.PublishedTo = pending.publish(post)
+			a.record(entry)
+		}(entry)
+	case decisionRejected, decisionAutoRejected:
+		// A superseded post needs no note, the newer post carries the current status
+		pending.withheld(post, decision)
+		a.record(entry)
+	default:
+		a.record(entry)
+	}
+	a.reviewer.resolved(ctx, pending, entry)
+	return true
+}
+
+// record appends the decision to the decision log.
+func (a *Approver) record(decision ApprovalDecision) {
+	if a.policy.LogPath == "" {
+		return
+	}
+	entry, err := json.Marshal(decision)
+	if err != nil {
+		log.Printf("Error encoding approval decision: %v", err)
+		return
+	}
+	a.logMu.Lock()
+	defer a.logMu.Unlock()
+	f, err := os.OpenFile(a.policy.LogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Error opening approval log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(entry, '\n')); err != nil {
+		log.Printf("Error writing approval log: %v", err)
+	}
+}
+
+// snapshot returns the pending posts, oldest first.
+func (a *Approver) snapshot() []*pendingPost {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	posts := make([]*pendingPost, 0, len(a.pending))
+	for _, pending := range a.pending {
+		posts = append(posts, pending)
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].Created.Before(posts[j].Created) })
+	return posts
+}
+
+func newReviewID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// httpReviewer serves pending posts on a local endpoint:
+//
+//	GET  /approvals                 lists pending posts
+//	POST /approvals/{id}/approve
+//	POST /approvals/{id}/reject
+//	POST /approvals/{id}/edit       with the corrected text as the body
+type httpReviewer struct {
+	approver *Approver
+}
+
+func (r *httpReviewer) start(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /approvals", func(w http.ResponseWriter, req *http.Request) {
+		type pendingView struct {
+			ID      string    `json:"id"`
+			Text    string    `json:"text"`
+			Danger  bool      `json:"danger"`
+			Created time.Time `json:"created"`
+			Expires time.Time `json:"expires"`
+		}
+		views := []pendingView{}
+		for _, pending := range r.approver.snapshot() {
+			views = append(views, pendingView{
+				ID:      pending.ID,
+				Text:    pending.Post.Text,
+				Danger:  pending.Post.Danger,
+				Created: pending.Created,
+				Expires: pending.Created.Add(r.approver.policy.Timeout),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(views)
+	})
+	mux.HandleFunc("POST /approvals/{id}/{action}", func(w http.ResponseWriter, req *http.Request) {
+		var decision, text string
+		switch req.PathValue("action") {
+		case "approve":
+			decision = decisionApproved
+		case "reject":
+			decision = decisionRejected
+		case "edit":
+			body, err := io.ReadAll(io.LimitReader(req.Body, 16*1024))
+			if err != nil || strings.TrimSpace(string(body)) == "" {
+				http.Error(w, "edit needs the corrected text as the request body", http.StatusBadRequest)
+				return
+			}
+			decision, text = decisionEdited, string(body)
+		default:
+			http.Error(w, "unknown action", http.StatusNotFound)
+			return
+		}
+		if !r.approver.decide(ctx, req.PathValue("id"), decision, text, "http:"+req.RemoteAddr) {
+			http.Error(w, "post is not pending", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(w, decision)
+	})
+
+	server := &http.Server{Addr: r.approver.policy.Addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Printf("Serving approvals on http://%s/approvals", server.Addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Approval endpoint stopped: %v", err)
+	}
+}
+
+func (r *httpReviewer) request(ctx context.Context, pending *pendingPost) error {
+	log.Printf("Review post %s at http://%s/approvals: %s", pending.ID, r.approver.policy.Addr, pending.Post.Text)
+	return nil
+}
+
+func (r *httpReviewer) resolved(ctx context.Context, pending *pendingPost, decision ApprovalDecision) {
+}
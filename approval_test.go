@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubReviewer accepts every review request and leaves decisions to the test.
+type stubReviewer struct{}
+
+func (stubReviewer) start(ctx context.Context)                                                     {}
+func (stubReviewer) request(ctx context.Context, pending *pendingPost) error                       { return nil }
+func (stubReviewer) resolved(ctx context.Context, pending *pendingPost, decision ApprovalDecision) {}
+
+func readApprovalLog(t *testing.T, path string) []ApprovalDecision {
+	t.Helper()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var decisions []ApprovalDecision
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var decision ApprovalDecision
+		if err := json.Unmarshal(scanner.Bytes(), &decision); err != nil {
+			t.Fatal(err)
+		}
+		decisions = append(decisions, decision)
+	}
+	return decisions
+}
+
+func TestApproverDecide(t *testing.T) {
+	tests := []struct {
+		decision      string
+		wantPublished bool
+		wantWithheld  bool
+	}{
+		{decision: decisionApproved, wantPublished: true},
+		{decision: decisionAutoApproved, wantPublished: true},
+		{decision: decisionRejected, wantWithheld: true},
+		{decision: decisionAutoRejected, wantWithheld: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.decision, func(t *testing.T) {
+			logPath := filepath.Join(t.TempDir(), "approvals.jsonl")
+			approver := &Approver{
+				policy:   ApprovalPolicy{Mode: approvalModeHTTP, Timeout: time.Hour, LogPath: logPath},
+				reviewer: stubReviewer{},
+				pending:  make(map[string]*pendingPost),
+			}
+
+			published := make(chan []string, 1)
+			withheld := ""
+			post := Post{Text: "Відбій", Response: AIJSONResponse{Text: "Відбій", StatusChanged: true}}
+			id := approver.Submit(context.Background(), post, func(post Post) []string {
+				sinks := []string{"telegram:@odesa"}
+				published <- sinks
+				return sinks
+			}, func(post Post, decision string) {
+				withheld = decision
+			})
+			if !approver.decide(context.Background(), id, tt.decision, "", "") {
+				t.Fatal("post was not pending")
+			}
+
+			if tt.wantPublished {
+				select {
+				case <-published:
+				case <-time.After(time.Second):
+					t.Fatal("approved post was not published")
+				}
+				// The decision is logged once publishing returned
+				deadline := time.Now().Add(time.Second)
+				for len(readApprovalLog(t, logPath)) == 0 && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			if (withheld != "") != tt.wantWithheld {
+				t.Fatalf("withheld = %q, want called %v", withheld, tt.wantWithheld)
+			}
+
+			decisions := readApprovalLog(t, logPath)
+			if len(decisions) != 1 || decisions[0].ID != id || decisions[0].Decision != tt.decision {
+				t.Fatalf("approval log = %+v", decisions)
+			}
+			if got := strings.Join(decisions[0].PublishedTo, ","); (got != "") != tt.wantPublished {
+				t.Fatalf("publishedTo = %q, want published %v", got, tt.wantPublished)
+			}
+		})
+	}
+}
+
+func TestPromptStateWithheldNote(t *testing.T) {
+	state := newPromptState(nil)
+	state.SetPublished(AIJSONResponse{Text: "Загроза шахедів", Danger: true})
+	state.SetWithheld(AIJSONResponse{Text: "Відбій"}, "rejected")
+
+	note := state.TakeWithheldNote()
+	if !strings.Contains(note, "Відбій") || !strings.Contains(note, "Загроза шахедів") {
+		t.Fatalf("note %q should name the withheld and the published post", note)
+	}
+	if again := state.TakeWithheldNote(); again != "" {
+		t.Fatalf("note returned twice: %q", again)
+	}
+
+	// Publishing a newer post makes the note obsolete
+	state.SetWithheld(AIJSONResponse{Text: "Відбій"}, "rejected")
+	state.SetPublished(AIJSONResponse{Text: "Тихо"})
+	if note := state.TakeWithheldNote(); note != "" {
+		t.Fatalf("note after publishing = %q, want none", note)
+	}
+}
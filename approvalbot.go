@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const botAPIEndpoint = "https://api.telegram.org/bot"
+
+// botPollTimeout is the long-polling timeout of getUpdates.
+const botPollTimeout = 30 * time.Second
+
+type botUser struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type botMessage struct {
+	MessageID int64 `json:"message_id"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	From    *botUser    `json:"from"`
+	Text    string      `json:"text"`
+	ReplyTo *botMessage `json:"reply_to_message"`
+}
+
+type botCallbackQuery struct {
+	ID      string      `json:"id"`
+	From    botUser     `json:"from"`
+	Data    string      `json:"data"`
+	Message *botMessage `json:"message"`
+}
+
+type botUpdate struct {
+	UpdateID      int64             `json:"update_id"`
+	Message       *botMessage       `json:"message"`
+	CallbackQuery *botCallbackQuery `json:"callback_query"`
+}
+
+// botReviewer posts pending posts to a review chat through the Bot API, with
+// Approve, Edit and Reject buttons. Edit asks for the corrected text as a reply.
+type botReviewer struct {
+	approver *Approver
+	client   *http.Client
+
+	mu sync.Mutex
+	// editPrompts maps the message asking for a correction to the post it edits
+	editPrompts map[int64]string
+}
+
+func newBotReviewer(approver *Approver) *botReviewer {
+	return &botReviewer{
+		approver:    approver,
+		client:      &http.Client{Timeout: botPollTimeout + 10*time.Second},
+		editPrompts: make(map[int64]string),
+	}
+}
+
+// call invokes a Bot API method and decodes its result into result when set.
+func (r *botReviewer) call(ctx context.Context, method string, params any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	token := r.approver.policy.BotToken
+	respBody, err := postJSON(ctx, r.client, "telegram bot", botAPIEndpoint+token+"/"+method, nil, body)
+	if err != nil {
+		// Transport errors quote the URL, keep the token out of the logs
+		return fmt.Errorf("bot API %s: %s", method, strings.ReplaceAll(err.Error(), token, "<token>"))
+	}
+	var resp struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return fmt.Errorf("bot API %s: %w", method, err)
+	}
+	if !resp.OK {
+		return fmt.Errorf("bot API %s: %s", method, resp.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+func (r *botReviewer) request(ctx context.Context, pending *pendingPost) error {
+	label := "✅ Оновлення"
+	if pending.Post.Danger {
+		label = "🚨 Небезпека"
+	}
+	text := fmt.Sprintf("%s, на перевірку (%s, автоматично через %v):\n\n%s",
+		label, pending.ID, r.approver.policy.Timeout, pending.Post.Text)
+	var sent botMessage
+	err := r.call(ctx, "sendMessage", map[string]any{
+		"chat_id": r.approver.policy.ChatID,
+		"text":    text,
+		"reply_markup": map[string]any{
+			"inline_keyboard": [][]map[string]string{{
+				{"text": "✅ Approve", "callback_data": "approve:" + pending.ID},
+				{"text": "✏️ Edit", "callback_data": "edit:" + pending.ID},
+				{"text": "❌ Reject", "callback_data": "reject:" + pending.ID},
+			}},
+		},
+	}, &sent)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	pending.reviewMessageID = int(sent.MessageID)
+	r.mu.Unlock()
+	return nil
+}
+
+// resolved replaces the buttons of the review message with the decision.
+func (r *botReviewer) resolved(ctx context.Context, pending *pendingPost, decision ApprovalDecision) {
+	r.mu.Lock()
+	messageID := pending.reviewMessageID
+	for promptID, id := range r.editPrompts {
+		if id == pending.ID {
+			delete(r.editPrompts, promptID)
+		}
+	}
+	r.mu.Unlock()
+	if messageID == 0 {
+		return
+	}
+
+	status := decision.Decision
+	if decision.Reviewer != "" {
+		status += " (" + decision.Reviewer + ")"
+	}
+	text := pending.Post.Text
+	if decision.Decision == decisionEdited {
+		text = decision.Text
+	}
+	if err := r.call(ctx, "editMessageText", map[string]any{
+		"chat_id":    r.approver.policy.ChatID,
+		"message_id": messageID,
+		"text":       text + "\n\n— " + status,
+	}, nil); err != nil {
+		log.Printf("Error updating review message of post %s: %v", pending.ID, err)
+	}
+}
+
+// start long-polls for button presses and edit replies.
+func (r *botReviewer) start(ctx context.Context) {
+	var offset int64
+	for ctx.Err() == nil {
+		var updates []botUpdate
+		err := r.call(ctx, "getUpdates", map[string]any{
+			"offset":          offset,
+			"timeout":         int(botPollTimeout.Seconds()),
+			"allowed_updates": []string{"message", "callback_query"},
+		}, &updates)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Error polling review chat: %v", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(5 * time.Second):
+				}
+			}
+			continue
+		}
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+			switch {
+			case update.CallbackQuery != nil:
+				r.handleCallback(ctx, update.CallbackQuery)
+			case update.Message != nil:
+				r.handleReply(ctx, update.Message)
+			}
+		}
+	}
+}
+
+// inReviewChat ignores updates from other chats the bot is a member of.
+func (r *botReviewer) inReviewChat(message *botMessage) bool {
+	return message != nil && fmt.Sprint(message.Chat.ID) == r.approver.policy.ChatID
+}
+
+func reviewerName(user botUser) string {
+	if user.Username != "" {
+		return "@" + user.Username
+	}
+	return fmt.Sprint(user.ID)
+}
+
+func (r *botReviewer) handleCallback(ctx context.Context, query *botCallbackQuery) {
+	answer := "Post is no longer pending"
+	action, id, _ := strings.Cut(query.Data, ":")
+	if r.inReviewChat(query.Message) {
+		switch action {
+		case "approve":
+			if r.approver.decide(ctx, id, decisionApproved, "", reviewerName(query.From)) {
+				answer = "Approved"
+			}
+		case "reject":
+			if r.approver.decide(ctx, id, decisionRejected, "", reviewerName(query.From)) {
+				answer = "Rejected"
+			}
+		case "edit":
+			answer = r.askForEdit(ctx, id, query.Message.MessageID)
+		}
+	}
+	if err := r.call(ctx, "answerCallbackQuery", map[string]any{"callback_query_id": query.ID, "text": answer}, nil); err != nil {
+		log.Printf("Error answering review button: %v", err)
+	}
+}
+
+// askForEdit replies to the review message asking for the corrected text.
+func (r *botReviewer) askForEdit(ctx context.Context, id string, reviewMessageID int64) string {
+	pendingIDs := make(map[string]bool)
+	for _, pending := range r.approver.snapshot() {
+		pendingIDs[pending.ID] = true
+	}
+	if !pendingIDs[id] {
+		return "Post is no longer pending"
+	}
+	var prompt botMessage
+	err := r.call(ctx, "sendMessage", map[string]any{
+		"chat_id":             r.approver.policy.ChatID,
+		"text":                "Надішліть виправлений текст відповіддю на це повідомлення (" + id + ")",
+		"reply_to_message_id": reviewMessageID,
+		"reply_markup":        map[string]any{"force_reply": true, "selective": true},
+	}, &prompt)
+	if err != nil {
+		log.Printf("Error asking for edit of post %s: %v", id, err)
+		return "Edit failed, try again"
+	}
+	r.mu.Lock()
+	r.editPrompts[prompt.MessageID] = id
+	r.mu.Unlock()
+	return "Reply with the corrected text"
+}
+
+// handleReply takes a reply to an edit prompt as the corrected text.
+func (r *botReviewer) handleReply(ctx context.Context, message *botMessage) {
+	if !r.inReviewChat(message) || message.ReplyTo == nil || strings.TrimSpace(message.Text) == "" {
+		return
+	}
+	r.mu.Lock()
+	id, ok := r.editPrompts[message.ReplyTo.MessageID]
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	reviewer := ""
+	if message.From != nil {
+		reviewer = reviewerName(*message.From)
+	}
+	r.approver.decide(ctx, id, decisionEdited, message.Text, reviewer)
+}
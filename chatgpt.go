@@ -1,33 +1,81 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"time"
 )
 
+// chatGPTModel is the default OpenAI model, override with CHATGPT_MODEL
+const chatGPTModel = "o3-mini"
+
 func (c *ChatGPTClient) AddMessageToHistory(message Message) {
-	c.MessageHistory = append(c.MessageHistory, message)
-	if len(c.MessageHistory) > maxMessageHistory {
-		c.MessageHistory = c.MessageHistory[1:]
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = appendHistory(c.MessageHistory, message, c.History)
 }
 
+// GetMessageHistory returns a copy of the current message history.
 func (c *ChatGPTClient) GetMessageHistory() []Message {
-	return c.MessageHistory
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return copyHistory(c.MessageHistory)
+}
+
+// SetSystemMessage replaces the system message used for subsequent requests.
+func (c *ChatGPTClient) SetSystemMessage(systemMessage string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SystemMessage = systemMessage
+}
+
+// ForgetRepair removes a validation repair exchange from the history.
+func (c *ChatGPTClient) ForgetRepair(request string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = withoutRepair(c.MessageHistory, request)
 }
 
 type responseFormat struct {
-	Type string `json:"type"`
+	Type       string      `json:"type"`
+	JSONSchema *jsonSchema `json:"json_schema,omitempty"`
+}
+
+// jsonSchema is the json_schema response format payload of OpenAI-compatible APIs.
+type jsonSchema struct {
+	Name   string                 `json:"name"`
+	Strict bool                   `json:"strict"`
+	Schema map[string]interface{} `json:"schema"`
+}
+
+// aiResponseFormat requests strict structured output matching AIJSONResponse.
+func aiResponseFormat() responseFormat {
+	return responseFormat{
+		Type: "json_schema",
+		JSONSchema: &jsonSchema{
+			Name:   aiResponseSchemaName,
+			Strict: true,
+			Schema: aiResponseSchema(),
+		},
+	}
 }
 
 func (c *ChatGPTClient) SendMessage(ctx context.Context, message Message) (AIJSONResponse, error) {
+	// Requests on one client are serialized so the conversation stays in order
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
 	c.AddMessageToHistory(message)
+	history := prepareHistory(ctx, &c.mu, &c.MessageHistory, c.History, "chatgpt")
+	c.mu.Lock()
+	systemMessage := c.SystemMessage
+	c.mu.Unlock()
+
+	model, textOnly := c.Usage.SelectModel("chatgpt", c.Model, c.FallbackModel)
+	if textOnly {
+		history = withoutImages(history)
+	}
 
 	url := "https://api.openai.com/v1/chat/completions"
 
@@ -36,11 +84,11 @@ func (c *ChatGPTClient) SendMessage(ctx context.Context, message Message) (AIJSO
 	// System message
 	apiMessages = append(apiMessages, map[string]interface{}{
 		"role":    "system",
-		"content": c.SystemMessage + "\n Текущее время: " + time.Now().Format("15:04:05"),
+		"content": c.Prompt.Render(systemMessage).String(),
 	})
 
 	// History messages
-	for _, msg := range c.MessageHistory {
+	for _, msg := range history {
 		if len(msg.Images) > 0 {
 			var contentParts []map[string]interface{}
 
@@ -75,49 +123,53 @@ func (c *ChatGPTClient) SendMessage(ctx context.Context, message Message) (AIJSO
 	}
 
 	reqBody, err := json.Marshal(map[string]interface{}{
-		"model":           "o3-mini",
-		"response_format": responseFormat{Type: "json_object"},
+		"model":           model,
+		"response_format": aiResponseFormat(),
 		"messages":        apiMessages,
 	})
 	if err != nil {
 		return AIJSONResponse{}, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
-	if err != nil {
-		return AIJSONResponse{}, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return AIJSONResponse{}, err
-	}
-	defer resp.Body.Close()
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", c.APIKey)}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return AIJSONResponse{}, err
-	}
+	var aiResp AIJSONResponse
+	err = c.Retry.Do(ctx, "chatgpt", func(ctx context.Context) error {
+		body, err := postJSON(ctx, c.HTTPClient, "chatgpt", url, headers, reqBody)
+		if err != nil {
+			return err
+		}
 
-	var chatGPTResp struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-	}
-	if err := json.Unmarshal(body, &chatGPTResp); err != nil {
-		return AIJSONResponse{}, err
-	}
+		var chatGPTResp struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+					Refusal string `json:"refusal"`
+				} `json:"message"`
+			} `json:"choices"`
+			Usage openAIUsage `json:"usage"`
+		}
+		if err := json.Unmarshal(body, &chatGPTResp); err != nil {
+			return malformed(err)
+		}
+		c.Usage.Record("chatgpt", model, chatGPTResp.Usage.tokenUsage(history, "chatgpt"))
 
-	var aiResp AIJSONResponse
-	if len(chatGPTResp.Choices) > 0 {
-		if err := json.Unmarshal([]byte(chatGPTResp.Choices[0].Message.Content), &aiResp); err != nil {
-			return AIJSONResponse{}, err
+		if len(chatGPTResp.Choices) == 0 {
+			return malformed(fmt.Errorf("no response from chatgpt"))
+		}
+		if refusal := chatGPTResp.Choices[0].Message.Refusal; refusal != "" {
+			return fmt.Errorf("chatgpt refused to answer: %s", refusal)
+		}
+		aiResp, err = parseAIJSON(chatGPTResp.Choices[0].Message.Content)
+		if err != nil {
+			return malformed(err)
 		}
-		c.AddMessageToHistory(Message{Role: "assistant", Content: fmt.Sprintf("%s Danger: %v StatusChanged: %v", aiResp.Text, aiResp.Danger, aiResp.StatusChanged)})
-		return aiResp, nil
+		return nil
+	})
+	if err != nil {
+		return AIJSONResponse{}, err
 	}
-	return AIJSONResponse{}, fmt.Errorf("no response from chatgpt")
+
+	c.AddMessageToHistory(Message{Role: "assistant", Content: fmt.Sprintf("%s Danger: %v StatusChanged: %v", aiResp.Text, aiResp.Danger, aiResp.StatusChanged)})
+	return aiResp, nil
 }
@@ -1,37 +1,174 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"log"
+	"strings"
 )
 
-func (c *ClaudeClient) AddMessageToHistory(message Message) {
-	c.MessageHistory = append(c.MessageHistory, message)
-	if len(c.MessageHistory) > maxMessageHistory {
-		c.MessageHistory = c.MessageHistory[1:]
+const (
+	claudeAPIEndpoint = "https://api.anthropic.com/v1/messages"
+	claudeAPIVersion  = "2023-06-01"
+	// claudeMaxTokens is the default answer limit, the Messages API requires one
+	claudeMaxTokens = 1024
+	// claudeMinThinkingBudget is the smallest thinking budget the API accepts
+	claudeMinThinkingBudget = 1024
+)
+
+// claudeToolInstruction replaces the forced tool_choice, which the API rejects
+// while extended thinking is enabled.
+const claudeToolInstruction = "Always answer by calling the " + aiResponseSchemaName + " tool exactly once."
+
+// claudeContentBlock is a single block of a Messages API response.
+type claudeContentBlock struct {
+	Type  string          `json:"type"`
+	Text  string          `json:"text"`
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input"`
+}
+
+// claudeUsage is the usage object of the Messages API. input_tokens excludes cached tokens.
+type claudeUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+}
+
+func (u claudeUsage) tokenUsage(history []Message) TokenUsage {
+	return TokenUsage{
+		Prompt:     u.InputTokens + u.CacheReadInputTokens + u.CacheCreationInputTokens,
+		Completion: u.OutputTokens,
+		Cached:     u.CacheReadInputTokens,
+		CacheWrite: u.CacheCreationInputTokens,
+		Image:      estimateHistoryImageTokens(history, "claude"),
+	}
+}
+
+// claudeModel is the default Anthropic model, override with CLAUDE_MODEL
+const claudeModel = "claude-sonnet-4-5"
+
+// loadClaudeThinkingBudget reads CLAUDE_THINKING_BUDGET, raising it to the API minimum when needed.
+func loadClaudeThinkingBudget() int {
+	budget := envInt("CLAUDE_THINKING_BUDGET", 0)
+	if budget > 0 && budget < claudeMinThinkingBudget {
+		log.Printf("CLAUDE_THINKING_BUDGET %d is below the minimum, using %d", budget, claudeMinThinkingBudget)
+		budget = claudeMinThinkingBudget
+	}
+	return budget
+}
+
+// claudeCacheControl marks a prompt caching breakpoint; everything up to and
+// including the marked block is cached for five minutes.
+var claudeCacheControl = map[string]string{"type": "ephemeral"}
+
+// markCacheBreakpoint puts a cache breakpoint on the last content block of an API message.
+func markCacheBreakpoint(apiMessage map[string]interface{}) {
+	switch content := apiMessage["content"].(type) {
+	case string:
+		apiMessage["content"] = []map[string]interface{}{{
+			"type":          "text",
+			"text":          content,
+			"cache_control": claudeCacheControl,
+		}}
+	case []map[string]interface{}:
+		if len(content) > 0 {
+			content[len(content)-1]["cache_control"] = claudeCacheControl
+		}
 	}
 }
 
+// claudeSystemBlocks splits the system prompt so the static part, which is long
+// and resent on every batch, is cached together with the tools. A templated
+// prompt changes on every request, so only the tools are cached then.
+func claudeSystemBlocks(prompt SystemPrompt) []map[string]interface{} {
+	var blocks []map[string]interface{}
+	if prompt.Static != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type":          "text",
+			"text":          prompt.Static,
+			"cache_control": claudeCacheControl,
+		})
+	}
+	if prompt.Dynamic != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "text", "text": prompt.Dynamic})
+	}
+	return blocks
+}
+
+// claudeAPIError fills the error type and message of an Anthropic error body,
+// e.g. {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}.
+func claudeAPIError(err error) error {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	var errResp struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(apiErr.Body), &errResp) == nil && errResp.Error.Type != "" {
+		apiErr.Type = errResp.Error.Type
+		apiErr.Body = errResp.Error.Message
+	}
+	return apiErr
+}
+
+func (c *ClaudeClient) AddMessageToHistory(message Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = appendHistory(c.MessageHistory, message, c.History)
+}
+
+// GetMessageHistory returns a copy of the current message history.
 func (c *ClaudeClient) GetMessageHistory() []Message {
-	return c.MessageHistory
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return copyHistory(c.MessageHistory)
+}
+
+// SetSystemMessage replaces the system message used for subsequent requests.
+func (c *ClaudeClient) SetSystemMessage(systemMessage string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SystemMessage = systemMessage
+}
+
+// ForgetRepair removes a validation repair exchange from the history.
+func (c *ClaudeClient) ForgetRepair(request string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = withoutRepair(c.MessageHistory, request)
 }
 
 func (c *ClaudeClient) SendMessage(ctx context.Context, message Message) (AIJSONResponse, error) {
+	// Requests on one client are serialized so the conversation stays in order
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
 	c.AddMessageToHistory(message)
+	history := prepareHistory(ctx, &c.mu, &c.MessageHistory, c.History, "claude")
+	c.mu.Lock()
+	systemMessage := c.SystemMessage
+	c.mu.Unlock()
 
-	url := "https://api.anthropic.com/v1/messages"
+	model, textOnly := c.Usage.SelectModel("claude", c.Model, c.FallbackModel)
+	if textOnly {
+		history = withoutImages(history)
+	}
 
 	var apiMessages []map[string]interface{}
 
-	for _, msg := range c.MessageHistory {
+	for _, msg := range history {
 		if len(msg.Images) > 0 {
 			var contentParts []map[string]interface{}
-			
+
 			// Add images
 			for _, img := range msg.Images {
 				contentParts = append(contentParts, map[string]interface{}{
@@ -64,50 +201,81 @@ func (c *ClaudeClient) SendMessage(ctx context.Context, message Message) (AIJSON
 		}
 	}
 
-	reqBody, err := json.Marshal(map[string]interface{}{
-		"model":    "claude-3-opus-20240229",
-		"system":   c.SystemMessage,
-		"messages": apiMessages,
-	})
-	if err != nil {
-		return AIJSONResponse{}, err
+	// Everything before the newest message is unchanged since the previous request, so it is cached
+	if len(apiMessages) > 1 {
+		markCacheBreakpoint(apiMessages[len(apiMessages)-2])
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
-	if err != nil {
-		return AIJSONResponse{}, err
+	// Structured output is obtained by forcing the model to call a tool whose input schema is AIJSONResponse
+	request := map[string]interface{}{
+		"model":      model,
+		"max_tokens": c.MaxTokens,
+		"messages":   apiMessages,
+		"tools": []map[string]interface{}{{
+			"name":         aiResponseSchemaName,
+			"description":  "Report the current situation to the channel",
+			"input_schema": aiResponseSchema(),
+			// Tools precede the system prompt in the cache prefix, so this holds even when the prompt changes
+			"cache_control": claudeCacheControl,
+		}},
 	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-api-key", c.APIKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
-
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return AIJSONResponse{}, err
+	prompt := c.Prompt.Render(systemMessage)
+	if c.ThinkingBudget > 0 {
+		// Thinking only allows tool_choice auto, so the tool call is requested in the prompt instead
+		prompt.Dynamic += "\n\n" + claudeToolInstruction
+		request["max_tokens"] = c.MaxTokens + c.ThinkingBudget
+		request["thinking"] = map[string]interface{}{"type": "enabled", "budget_tokens": c.ThinkingBudget}
+		request["tool_choice"] = map[string]string{"type": "auto"}
+	} else {
+		request["tool_choice"] = map[string]string{"type": "tool", "name": aiResponseSchemaName}
 	}
-	defer resp.Body.Close()
+	request["system"] = claudeSystemBlocks(prompt)
 
-	body, err := io.ReadAll(resp.Body)
+	reqBody, err := json.Marshal(request)
 	if err != nil {
 		return AIJSONResponse{}, err
 	}
 
-	var claudeResp struct {
-		Content []struct {
-			Text string `json:"text"`
-		} `json:"content"`
-	}
-	if err := json.Unmarshal(body, &claudeResp); err != nil {
-		return AIJSONResponse{}, err
-	}
-
-	if len(claudeResp.Content) == 0 {
-		return AIJSONResponse{}, fmt.Errorf("empty response from claude")
+	headers := map[string]string{
+		"x-api-key":         c.APIKey,
+		"anthropic-version": claudeAPIVersion,
 	}
 
 	var aiResp AIJSONResponse
-	if err := json.Unmarshal([]byte(claudeResp.Content[0].Text), &aiResp); err != nil {
+	err = c.Retry.Do(ctx, "claude", func(ctx context.Context) error {
+		body, err := postJSON(ctx, c.HTTPClient, "claude", claudeAPIEndpoint, headers, reqBody)
+		if err != nil {
+			return claudeAPIError(err)
+		}
+
+		var claudeResp struct {
+			Content    []claudeContentBlock `json:"content"`
+			StopReason string               `json:"stop_reason"`
+			Usage      claudeUsage          `json:"usage"`
+		}
+		if err := json.Unmarshal(body, &claudeResp); err != nil {
+			return malformed(err)
+		}
+		c.Usage.Record("claude", model, claudeResp.Usage.tokenUsage(history))
+
+		if len(claudeResp.Content) == 0 {
+			return malformed(fmt.Errorf("empty response from claude"))
+		}
+
+		aiResp, err = parseClaudeContent(claudeResp.Content)
+		if err != nil {
+			switch claudeResp.StopReason {
+			case "max_tokens":
+				// A retry would be cut off at the same place
+				return fmt.Errorf("claude answer truncated at %d tokens, raise CLAUDE_MAX_TOKENS: %w", c.MaxTokens, err)
+			case "refusal":
+				return fmt.Errorf("claude refused to answer: %w", err)
+			}
+			return malformed(err)
+		}
+		return nil
+	})
+	if err != nil {
 		return AIJSONResponse{}, err
 	}
 
@@ -115,3 +283,25 @@ func (c *ClaudeClient) SendMessage(ctx context.Context, message Message) (AIJSON
 
 	return aiResp, nil
 }
+
+// parseClaudeContent reads the forced tool call input, falling back to any text
+// block in case the model answered in prose. Thinking blocks are skipped.
+func parseClaudeContent(blocks []claudeContentBlock) (AIJSONResponse, error) {
+	var text strings.Builder
+	for _, block := range blocks {
+		switch block.Type {
+		case "tool_use":
+			if block.Name != aiResponseSchemaName {
+				continue
+			}
+			var aiResp AIJSONResponse
+			if err := json.Unmarshal(block.Input, &aiResp); err != nil {
+				return AIJSONResponse{}, fmt.Errorf("failed to unmarshal claude tool input: %w (input: %s)", err, string(block.Input))
+			}
+			return aiResp, nil
+		case "text":
+			text.WriteString(block.Text)
+		}
+	}
+	return parseAIJSON(text.String())
+}
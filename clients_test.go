@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// redirectTransport sends every request to the test server, keeping the path so
+// the server can tell the provider APIs apart.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	req.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// fakeProviderServer answers every provider API with the same verdict.
+func fakeProviderServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	answer, err := json.Marshal(AIJSONResponse{Text: "Тихо", Principle: "no threats"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body any
+		switch {
+		case r.URL.Path == "/v1/messages":
+			body = map[string]any{"content": []map[string]any{{"type": "text", "text": string(answer)}}}
+		case strings.HasSuffix(r.URL.Path, ":generateContent"):
+			body = map[string]any{"candidates": []map[string]any{{"content": map[string]any{"parts": []map[string]string{{"text": string(answer)}}}}}}
+		default:
+			body = map[string]any{"choices": []map[string]any{{"message": map[string]string{"content": string(answer)}}}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}))
+}
+
+// testClients returns one client of every provider talking to the test server.
+func testClients(t *testing.T, server *httptest.Server) map[string]AIClient {
+	t.Helper()
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpClient := &http.Client{Transport: redirectTransport{target: target}}
+	retry := RetryPolicy{MaxAttempts: 1}
+	history := HistoryPolicy{MaxMessages: 1000, ImageTurns: -1}
+	return map[string]AIClient{
+		"claude":     &ClaudeClient{HTTPClient: httpClient, Retry: retry, History: history, Model: claudeModel, MaxTokens: claudeMaxTokens},
+		"chatgpt":    &ChatGPTClient{HTTPClient: httpClient, Retry: retry, History: history, Model: chatGPTModel},
+		"openrouter": &OpenRouterClient{HTTPClient: httpClient, Retry: retry, History: history, Model: openRouterModel},
+		"gemini":     &GeminiClient{HTTPClient: httpClient, Retry: retry, History: history, Model: geminiModel},
+		"deepseek":   &DeepseekClient{HTTPClient: httpClient, Retry: retry, History: history, Model: deepseekModel},
+		"glm":        &GLMClient{HTTPClient: httpClient, Retry: retry, History: history, Model: glmModel},
+		"local":      &LocalClient{HTTPClient: httpClient, Retry: retry, History: history, Model: "local", Endpoint: server.URL + "/v1/chat/completions"},
+	}
+}
+
+// Run with -race: SendMessage, SetSystemMessage and GetMessageHistory are
+// called from the alert loop, the prompt watcher and the exchange log at once.
+func TestClientsConcurrentUse(t *testing.T) {
+	server := fakeProviderServer(t)
+	defer server.Close()
+
+	const sends = 8
+	for name, client := range testClients(t, server) {
+		t.Run(name, func(t *testing.T) {
+			setter, ok := client.(systemMessageSetter)
+			if !ok {
+				t.Fatalf("%s client cannot replace its system message", name)
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < sends; i++ {
+				wg.Add(3)
+				go func(i int) {
+					defer wg.Done()
+					if _, err := client.SendMessage(context.Background(), Message{Role: "user", Content: fmt.Sprintf("message %d", i)}); err != nil {
+						t.Errorf("SendMessage: %v", err)
+					}
+				}(i)
+				go func(i int) {
+					defer wg.Done()
+					setter.SetSystemMessage(fmt.Sprintf("system message %d", i))
+				}(i)
+				go func() {
+					defer wg.Done()
+					client.GetMessageHistory()
+				}()
+			}
+			wg.Wait()
+
+			history := client.GetMessageHistory()
+			if len(history) != 2*sends {
+				t.Fatalf("history has %d messages, want %d", len(history), 2*sends)
+			}
+			// Serialized sends keep every answer right after its question
+			for i, message := range history {
+				want := "user"
+				if i%2 == 1 {
+					want = "assistant"
+				}
+				if message.Role != want {
+					t.Fatalf("message %d has role %s, want %s", i, message.Role, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetMessageHistoryReturnsCopy(t *testing.T) {
+	server := fakeProviderServer(t)
+	defer server.Close()
+
+	for name, client := range testClients(t, server) {
+		t.Run(name, func(t *testing.T) {
+			client.AddMessageToHistory(Message{Role: "user", Content: "original"})
+
+			history := client.GetMessageHistory()
+			history[0].Content = "changed"
+			history = append(history, Message{Role: "assistant", Content: "appended"})
+			_ = history
+
+			got := client.GetMessageHistory()
+			if len(got) != 1 || got[0].Content != "original" {
+				t.Fatalf("client history changed through the returned slice: %+v", got)
+			}
+		})
+	}
+}
@@ -6,32 +6,71 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
-	"strings"
-	"time"
+	"sync"
 )
 
 type DeepseekClient struct {
 	APIKey         string
 	HTTPClient     *http.Client
+	Retry          RetryPolicy
+	History        HistoryPolicy
 	SystemMessage  string
 	MessageHistory []Message
+	Model          string
+	FallbackModel  string
+	Usage          *UsageTracker
+	Prompt         *PromptState
+	// mu guards SystemMessage and MessageHistory; sendMu serializes SendMessage calls
+	mu     sync.Mutex
+	sendMu sync.Mutex
 }
 
+// deepseekModel is the default DeepSeek model, override with DEEPSEEK_MODEL
+const deepseekModel = "deepseek-chat"
+
 func (c *DeepseekClient) AddMessageToHistory(message Message) {
-	c.MessageHistory = append(c.MessageHistory, message)
-	if len(c.MessageHistory) > maxMessageHistory {
-		c.MessageHistory = c.MessageHistory[1:]
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = appendHistory(c.MessageHistory, message, c.History)
 }
 
+// GetMessageHistory returns a copy of the current message history.
 func (c *DeepseekClient) GetMessageHistory() []Message {
-	return c.MessageHistory
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return copyHistory(c.MessageHistory)
+}
+
+// SetSystemMessage replaces the system message used for subsequent requests.
+func (c *DeepseekClient) SetSystemMessage(systemMessage string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SystemMessage = systemMessage
+}
+
+// ForgetRepair removes a validation repair exchange from the history.
+func (c *DeepseekClient) ForgetRepair(request string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = withoutRepair(c.MessageHistory, request)
 }
 
 func (c *DeepseekClient) SendMessage(ctx context.Context, message Message) (AIJSONResponse, error) {
+	// Requests on one client are serialized so the conversation stays in order
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
 	c.AddMessageToHistory(message)
+	history := prepareHistory(ctx, &c.mu, &c.MessageHistory, c.History, "deepseek")
+	c.mu.Lock()
+	systemMessage := c.SystemMessage
+	c.mu.Unlock()
+
+	model, textOnly := c.Usage.SelectModel("deepseek", c.Model, c.FallbackModel)
+	if textOnly {
+		history = withoutImages(history)
+	}
 
 	url := "https://api.deepseek.com/v1/chat/completions"
 
@@ -40,14 +79,14 @@ func (c *DeepseekClient) SendMessage(ctx context.Context, message Message) (AIJS
 	// System message
 	apiMessages = append(apiMessages, map[string]interface{}{
 		"role":    "system",
-		"content": c.SystemMessage + "\n Current time: " + time.Now().Format("15:04:05"),
+		"content": c.Prompt.Render(systemMessage).String() + "\n" + schemaInstruction(),
 	})
 
 	// History messages
-	for _, msg := range c.MessageHistory {
+	for _, msg := range history {
 		if len(msg.Images) > 0 {
 			var contentParts []map[string]interface{}
-			
+
 			// Add text
 			if msg.Content != "" {
 				contentParts = append(contentParts, map[string]interface{}{
@@ -79,62 +118,56 @@ func (c *DeepseekClient) SendMessage(ctx context.Context, message Message) (AIJS
 	}
 
 	reqBody, err := json.Marshal(map[string]interface{}{
-		"model":    "deepseek-chat",
+		"model":    model,
 		"messages": apiMessages,
+		// DeepSeek supports JSON mode but not schemas; the schema is described in the system prompt
+		"response_format": responseFormat{Type: "json_object"},
 	})
 	if err != nil {
 		return AIJSONResponse{}, err
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
-	if err != nil {
-		return AIJSONResponse{}, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return AIJSONResponse{}, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return AIJSONResponse{}, err
-	}
-
-	// Handle UTF-8 BOM and clean response body
-	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
-
-	var deepseekResp struct {
-		Choices []struct {
-			Message struct {
-				Content string `json:"content"`
-			} `json:"message"`
-		} `json:"choices"`
-		Error struct {
-			Message string `json:"message"`
-		} `json:"error"`
-	}
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", c.APIKey)}
 
-	if err := json.Unmarshal(body, &deepseekResp); err != nil {
-		return AIJSONResponse{}, fmt.Errorf("failed to parse API response: %w (body: %q)", err, string(body))
-	}
+	var aiResp AIJSONResponse
+	err = c.Retry.Do(ctx, "deepseek", func(ctx context.Context) error {
+		body, err := postJSON(ctx, c.HTTPClient, "deepseek", url, headers, reqBody)
+		if err != nil {
+			return err
+		}
 
-	if len(deepseekResp.Choices) == 0 {
-		return AIJSONResponse{}, fmt.Errorf("no choices in response: %s", deepseekResp.Error.Message)
-	}
+		// Handle UTF-8 BOM and clean response body
+		body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+
+		var deepseekResp struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+			Usage openAIUsage `json:"usage"`
+		}
 
-	// Clean and parse the JSON content
-	content := strings.TrimSpace(strings.TrimPrefix(strings.TrimSuffix(deepseekResp.Choices[0].Message.Content, "```"), "```json"))
+		if err := json.Unmarshal(body, &deepseekResp); err != nil {
+			return malformed(fmt.Errorf("failed to parse API response: %w (body: %q)", err, string(body)))
+		}
+		c.Usage.Record("deepseek", model, deepseekResp.Usage.tokenUsage(history, "deepseek"))
 
-	if !strings.HasPrefix(content, "{") {
-		return AIJSONResponse{}, fmt.Errorf("unexpected response format, expected JSON object but got: %q", content)
-	}
+		if len(deepseekResp.Choices) == 0 {
+			return malformed(fmt.Errorf("no choices in response: %s", deepseekResp.Error.Message))
+		}
 
-	var aiResp AIJSONResponse
-	if err := json.Unmarshal([]byte(content), &aiResp); err != nil {
-		return AIJSONResponse{}, fmt.Errorf("failed to unmarshal JSON content: %w (content: %q)", err, content)
+		aiResp, err = parseAIJSON(deepseekResp.Choices[0].Message.Content)
+		if err != nil {
+			return malformed(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return AIJSONResponse{}, err
 	}
 
 	c.AddMessageToHistory(Message{Role: "assistant", Content: fmt.Sprintf("%s Danger: %v StatusChanged: %v", aiResp.Text, aiResp.Danger, aiResp.StatusChanged)})
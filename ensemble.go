@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ensemble merge policies
+const (
+	// ensemblePolicyMajority flags a field when more than half of the answering models flag it.
+	ensemblePolicyMajority = "majority"
+	// ensemblePolicyAnyDanger flags a field as soon as any answering model flags it.
+	ensemblePolicyAnyDanger = "any-danger"
+	// ensemblePolicyWeighted flags a field when the weights of the models flagging it exceed half of the total weight.
+	ensemblePolicyWeighted = "weighted"
+)
+
+// EnsembleMember is a single provider taking part in an ensemble.
+type EnsembleMember struct {
+	Name   string
+	Client AIClient
+	Weight float64
+}
+
+// EnsembleClient implements the AIClient interface by sending every batch to several
+// providers at once and merging their Danger/StatusChanged verdicts.
+// Text and Principle are taken from the primary member, or from another member
+// when the primary failed.
+type EnsembleClient struct {
+	Members []EnsembleMember
+	Policy  string
+	Primary string
+	// LogFile, when set, receives one JSON line per disagreement for later review.
+	LogFile string
+}
+
+// ensembleResult is the outcome of a single member request.
+type ensembleResult struct {
+	Name     string         `json:"name"`
+	Response AIJSONResponse `json:"response"`
+	Error    string         `json:"error,omitempty"`
+	err      error
+}
+
+func newEnsembleClient(config Config, systemMessage string) (*EnsembleClient, error) {
+	if len(config.EnsembleProviders) < 2 {
+		return nil, fmt.Errorf("ensemble requires at least two providers in ENSEMBLE_PROVIDERS, got %d", len(config.EnsembleProviders))
+	}
+
+	policy := strings.ToLower(config.EnsemblePolicy)
+	switch policy {
+	case ensemblePolicyMajority, ensemblePolicyAnyDanger, ensemblePolicyWeighted:
+	default:
+		return nil, fmt.Errorf("unknown ensemble policy: %s", config.EnsemblePolicy)
+	}
+
+	ensemble := &EnsembleClient{
+		Policy:  policy,
+		Primary: strings.ToLower(config.EnsemblePrimary),
+		LogFile: config.EnsembleLogFile,
+	}
+
+	for _, provider := range config.EnsembleProviders {
+		name := strings.ToLower(provider)
+		if name == "ensemble" {
+			return nil, fmt.Errorf("ensemble cannot contain another ensemble")
+		}
+		client, err := newAIClient(config, name, systemMessage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize ensemble member %s: %w", name, err)
+		}
+		weight, ok := config.EnsembleWeights[name]
+		if !ok {
+			weight = 1
+		}
+		ensemble.Members = append(ensemble.Members, EnsembleMember{Name: name, Client: client, Weight: weight})
+	}
+
+	if ensemble.Primary == "" {
+		ensemble.Primary = ensemble.Members[0].Name
+	}
+	if ensemble.primaryMember() == nil {
+		return nil, fmt.Errorf("ensemble primary %s is not one of the providers", ensemble.Primary)
+	}
+
+	log.Printf("Initialized ensemble with %d members (policy: %s, primary: %s)", len(ensemble.Members), ensemble.Policy, ensemble.Primary)
+	return ensemble, nil
+}
+
+func (e *EnsembleClient) primaryMember() *EnsembleMember {
+	for i := range e.Members {
+		if e.Members[i].Name == e.Primary {
+			return &e.Members[i]
+		}
+	}
+	return nil
+}
+
+// AddMessageToHistory adds a message to the history of every member.
+func (e *EnsembleClient) AddMessageToHistory(message Message) {
+	for _, member := range e.Members {
+		member.Client.AddMessageToHistory(message)
+	}
+}
+
+// ForgetRepair removes the repair exchange from the history of every member.
+func (e *EnsembleClient) ForgetRepair(request string) {
+	for _, member := range e.Members {
+		if forgetter, ok := member.Client.(repairForgetter); ok {
+			forgetter.ForgetRepair(request)
+		}
+	}
+}
+
+// GetMessageHistory returns the history of the primary member.
+func (e *EnsembleClient) GetMessageHistory() []Message {
+	if primary := e.primaryMember(); primary != nil {
+		return primary.Client.GetMessageHistory()
+	}
+	return nil
+}
+
+// SendMessage sends the message to all members concurrently and merges the answers.
+// It fails only when no member returned a usable response.
+func (e *EnsembleClient) SendMessage(ctx context.Context, message Message) (AIJSONResponse, error) {
+	results := make([]ensembleResult, len(e.Members))
+
+	var wg sync.WaitGroup
+	for i, member := range e.Members {
+		wg.Add(1)
+		go func(i int, member EnsembleMember) {
+			defer wg.Done()
+			resp, err := member.Client.SendMessage(ctx, message)
+			results[i] = ensembleResult{Name: member.Name, Response: resp, err: err}
+			if err != nil {
+				results[i].Error = err.Error()
+				log.Printf("Ensemble member %s failed: %v", member.Name, err)
+			}
+		}(i, member)
+	}
+	wg.Wait()
+
+	merged, err := e.merge(results)
+	if err != nil {
+		return AIJSONResponse{}, err
+	}
+	e.reportDisagreement(results, merged)
+	return merged, nil
+}
+
+// merge combines member responses according to the configured policy.
+func (e *EnsembleClient) merge(results []ensembleResult) (AIJSONResponse, error) {
+	var answered []ensembleResult
+	var totalWeight, dangerWeight, changedWeight float64
+	dangerVotes, changedVotes := 0, 0
+
+	for i, result := range results {
+		if result.err != nil {
+			continue
+		}
+		answered = append(answered, result)
+		weight := e.Members[i].Weight
+		totalWeight += weight
+		if result.Response.Danger {
+			dangerVotes++
+			dangerWeight += weight
+		}
+		if result.Response.StatusChanged {
+			changedVotes++
+			changedWeight += weight
+		}
+	}
+
+	if len(answered) == 0 {
+		return AIJSONResponse{}, fmt.Errorf("all %d ensemble members failed", len(results))
+	}
+
+	var danger, changed bool
+	switch e.Policy {
+	case ensemblePolicyAnyDanger:
+		danger = dangerVotes > 0
+		changed = changedVotes > 0
+	case ensemblePolicyWeighted:
+		danger = totalWeight > 0 && dangerWeight > totalWeight/2
+		changed = totalWeight > 0 && changedWeight > totalWeight/2
+	default:
+		danger = dangerVotes*2 > len(answered)
+		changed = changedVotes*2 > len(answered)
+	}
+
+	// The structured fields come with the text so they describe the same threat
+	merged := e.textSource(answered, danger).Response
+	merged.Danger = danger
+	merged.StatusChanged = changed
+	return merged, nil
+}
+
+// textSource picks the response whose text is published. The primary member is
+// used whenever it answered, even when it was outvoted on Danger; the conflict is
+// logged by reportDisagreement. If the primary failed, the heaviest member that
+// agrees with the merged Danger verdict is used, so the text matches the emoji.
+func (e *EnsembleClient) textSource(answered []ensembleResult, danger bool) ensembleResult {
+	var best *ensembleResult
+	bestWeight := -1.0
+	for i := range answered {
+		result := &answered[i]
+		if result.Name == e.Primary {
+			return *result
+		}
+		if result.Response.Danger != danger {
+			continue
+		}
+		if weight := e.weightOf(result.Name); weight > bestWeight {
+			best, bestWeight = result, weight
+		}
+	}
+	if best != nil {
+		log.Printf("Ensemble primary %s unavailable, using text from %s", e.Primary, best.Name)
+		return *best
+	}
+	return answered[0]
+}
+
+func (e *EnsembleClient) weightOf(name string) float64 {
+	for _, member := range e.Members {
+		if member.Name == name {
+			return member.Weight
+		}
+	}
+	return 0
+}
+
+// reportDisagreement logs the individual verdicts whenever the answering members did not agree.
+func (e *EnsembleClient) reportDisagreement(results []ensembleResult, merged AIJSONResponse) {
+	var first *AIJSONResponse
+	disagree := false
+	for i := range results {
+		if results[i].err != nil {
+			continue
+		}
+		resp := &results[i].Response
+		if first == nil {
+			first = resp
+			continue
+		}
+		if resp.Danger != first.Danger || resp.StatusChanged != first.StatusChanged {
+			disagree = true
+			break
+		}
+	}
+	if !disagree {
+		return
+	}
+
+	var votes []string
+	for _, result := range results {
+		if result.err != nil {
+			votes = append(votes, fmt.Sprintf("%s=error", result.Name))
+			continue
+		}
+		votes = append(votes, fmt.Sprintf("%s=danger:%v/changed:%v", result.Name, result.Response.Danger, result.Response.StatusChanged))
+	}
+	log.Printf("Ensemble disagreement (policy: %s): %s -> danger:%v/changed:%v",
+		e.Policy, strings.Join(votes, ", "), merged.Danger, merged.StatusChanged)
+
+	if e.LogFile == "" {
+		return
+	}
+	entry, err := json.Marshal(struct {
+		Time    time.Time        `json:"time"`
+		Policy  string           `json:"policy"`
+		Members []ensembleResult `json:"members"`
+		Merged  AIJSONResponse   `json:"merged"`
+	}{time.Now(), e.Policy, results, merged})
+	if err != nil {
+		log.Printf("Error encoding ensemble disagreement: %v", err)
+		return
+	}
+	f, err := os.OpenFile(e.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Error opening ensemble disagreement log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(entry, '\n')); err != nil {
+		log.Printf("Error writing ensemble disagreement log: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEnsembleMerge(t *testing.T) {
+	verdict := func(name string, danger, changed bool) ensembleResult {
+		return ensembleResult{Name: name, Response: AIJSONResponse{Text: "text from " + name, Danger: danger, StatusChanged: changed}}
+	}
+	failed := func(name string) ensembleResult {
+		return ensembleResult{Name: name, err: errors.New("timeout")}
+	}
+
+	tests := []struct {
+		name        string
+		policy      string
+		weights     []float64
+		results     []ensembleResult
+		wantDanger  bool
+		wantChanged bool
+		wantText    string
+		wantErr     bool
+	}{
+		{
+			name:    "majority",
+			policy:  ensemblePolicyMajority,
+			results: []ensembleResult{verdict("a", true, true), verdict("b", true, false), verdict("c", false, false)},
+			// a and b see danger, only a sees a change
+			wantDanger: true, wantChanged: false, wantText: "text from a",
+		},
+		{
+			name:       "majority needs more than half",
+			policy:     ensemblePolicyMajority,
+			results:    []ensembleResult{verdict("a", true, true), verdict("b", false, false)},
+			wantDanger: false, wantChanged: false, wantText: "text from a",
+		},
+		{
+			name:       "any danger",
+			policy:     ensemblePolicyAnyDanger,
+			results:    []ensembleResult{verdict("a", false, false), verdict("b", false, false), verdict("c", true, true)},
+			wantDanger: true, wantChanged: true, wantText: "text from a",
+		},
+		{
+			name:       "weighted",
+			policy:     ensemblePolicyWeighted,
+			weights:    []float64{1, 1, 3},
+			results:    []ensembleResult{verdict("a", false, false), verdict("b", false, false), verdict("c", true, true)},
+			wantDanger: true, wantChanged: true, wantText: "text from a",
+		},
+		{
+			name:       "weighted ignores failed members",
+			policy:     ensemblePolicyWeighted,
+			weights:    []float64{1, 1, 3},
+			results:    []ensembleResult{verdict("a", true, false), verdict("b", false, false), failed("c")},
+			wantDanger: false, wantChanged: false, wantText: "text from a",
+		},
+		{
+			name:    "all failed",
+			policy:  ensemblePolicyMajority,
+			results: []ensembleResult{failed("a"), failed("b")},
+			wantErr: true,
+		},
+		{
+			name:       "primary failed",
+			policy:     ensemblePolicyMajority,
+			weights:    []float64{1, 1, 2},
+			results:    []ensembleResult{failed("a"), verdict("b", true, true), verdict("c", true, true)},
+			wantDanger: true, wantChanged: true, wantText: "text from c",
+		},
+		{
+			name:       "primary failed, fallback agrees with the verdict",
+			policy:     ensemblePolicyAnyDanger,
+			weights:    []float64{1, 1, 2},
+			results:    []ensembleResult{failed("a"), verdict("b", true, true), verdict("c", false, false)},
+			wantDanger: true, wantChanged: true, wantText: "text from b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ensemble := &EnsembleClient{Policy: tt.policy, Primary: "a"}
+			for i, result := range tt.results {
+				weight := 1.0
+				if tt.weights != nil {
+					weight = tt.weights[i]
+				}
+				ensemble.Members = append(ensemble.Members, EnsembleMember{Name: result.Name, Weight: weight})
+			}
+
+			merged, err := ensemble.merge(tt.results)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if merged.Danger != tt.wantDanger || merged.StatusChanged != tt.wantChanged {
+				t.Fatalf("danger:%v/changed:%v, want danger:%v/changed:%v", merged.Danger, merged.StatusChanged, tt.wantDanger, tt.wantChanged)
+			}
+			if merged.Text != tt.wantText {
+				t.Fatalf("text = %q, want %q", merged.Text, tt.wantText)
+			}
+		})
+	}
+}
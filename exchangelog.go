@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ExchangeRecord is one AI exchange as written to the exchange log. Prompts maps
+// each provider to the name@version of the prompt it was given, so outcomes such
+// as false alarms can be compared between prompt versions.
+type ExchangeRecord struct {
+	Time     time.Time         `json:"time"`
+	Provider string            `json:"provider"`
+	Prompts  map[string]string `json:"prompts"`
+	Response *AIJSONResponse   `json:"response,omitempty"`
+	// Published is true when the response was sent to at least one sink, listed in PublishedTo
+	Published   bool     `json:"published"`
+	PublishedTo []string `json:"publishedTo,omitempty"`
+	// ReviewID links the post to the approval log when it was held for review;
+	// Published stays false then and the log entry of the decision lists the sinks
+	ReviewID string `json:"reviewId,omitempty"`
+	// Suppressed is why the publish guard held the post back; a "rate" post was
+	// deferred and published later unless a newer post superseded it
+	Suppressed string `json:"suppressed,omitempty"`
+	// Error is set when the exchange failed or the response was dropped
+	Error string `json:"error,omitempty"`
+}
+
+// ExchangeLog appends exchange records to a JSONL file. A nil log records nothing.
+type ExchangeLog struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// loadExchangeLog returns the log at AI_EXCHANGE_LOG, e.g. config/exchanges.jsonl.
+// The log is off unless the path is set; it is never rotated, so it is meant for
+// prompt experiments rather than for running all the time.
+func loadExchangeLog() *ExchangeLog {
+	path := getEnv("AI_EXCHANGE_LOG", "")
+	if path == "" {
+		return nil
+	}
+	return &ExchangeLog{Path: path}
+}
+
+// Record appends one exchange. Failures are logged and otherwise ignored.
+func (l *ExchangeLog) Record(record ExchangeRecord) {
+	if l == nil {
+		return
+	}
+	entry, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error encoding exchange record: %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Error opening exchange log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(entry, '\n')); err != nil {
+		log.Printf("Error writing exchange log: %v", err)
+	}
+}
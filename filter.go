@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const filtersFile = "config/filters.json"
+
+// Filter metrics, served on /debug/vars when METRICS_ADDR is set. Dropped and
+// would-drop counts are keyed by "<channel>:<reason>".
+var (
+	filterPassed    = expvar.NewMap("filter_passed")
+	filterDropped   = expvar.NewMap("filter_dropped")
+	filterWouldDrop = expvar.NewMap("filter_would_drop")
+)
+
+// FilterRules decide which messages of a channel reach the AI. Keywords match
+// case-insensitively as substrings; regexes use Go syntax, add (?i) as needed.
+type FilterRules struct {
+	// AllowKeywords and AllowRegex, when any is set, require a text to match one of them
+	AllowKeywords []string `json:"allowKeywords"`
+	AllowRegex    []string `json:"allowRegex"`
+	// DenyKeywords and DenyRegex drop a text matching any of them
+	DenyKeywords []string `json:"denyKeywords"`
+	DenyRegex    []string `json:"denyRegex"`
+	// MinLength is the minimum text length in characters
+	MinLength int `json:"minLength"`
+	// Languages lists the accepted languages: uk, ru, en
+	Languages []string `json:"languages"`
+
+	allowRegex []*regexp.Regexp
+	denyRegex  []*regexp.Regexp
+}
+
+// FilterConfig is the content of config/filters.json. A channel listed in
+// Channels uses its own rules instead of Default; Spam applies to every channel.
+type FilterConfig struct {
+	// DryRun logs what would be dropped but lets everything through
+	DryRun   bool                    `json:"dryRun"`
+	Default  *FilterRules            `json:"default"`
+	Channels map[string]*FilterRules `json:"channels"`
+	Spam     []string                `json:"spam"`
+
+	spam []*regexp.Regexp
+}
+
+// MessageFilter drops irrelevant messages before they are buffered for the AI.
+// A nil filter lets everything through.
+type MessageFilter struct {
+	config FilterConfig
+}
+
+// loadMessageFilter reads FILTERS_FILE. A missing file disables filtering.
+func loadMessageFilter() (*MessageFilter, error) {
+	path := getEnv("FILTERS_FILE", filtersFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading filters file: %v", err)
+	}
+
+	var config FilterConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing filters file %s: %v", path, err)
+	}
+	if getEnv("FILTERS_DRY_RUN", "") == "true" {
+		config.DryRun = true
+	}
+
+	if config.spam, err = compilePatterns(config.Spam); err != nil {
+		return nil, fmt.Errorf("invalid spam pattern: %v", err)
+	}
+	rules := map[string]*FilterRules{"default": config.Default}
+	for channel, channelRules := range config.Channels {
+		rules[channel] = channelRules
+	}
+	for name, r := range rules {
+		if r == nil {
+			continue
+		}
+		if r.allowRegex, err = compilePatterns(r.AllowRegex); err != nil {
+			return nil, fmt.Errorf("invalid allow pattern for %s: %v", name, err)
+		}
+		if r.denyRegex, err = compilePatterns(r.DenyRegex); err != nil {
+			return nil, fmt.Errorf("invalid deny pattern for %s: %v", name, err)
+		}
+	}
+
+	log.Printf("Loaded message filter from %s: %d channel rule set(s), %d spam pattern(s), dry run %v",
+		path, len(config.Channels), len(config.spam), config.DryRun)
+	return &MessageFilter{config: config}, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Allow reports whether a message from the channel should reach the AI. Text
+// rules other than spam and deny lists are skipped for messages with a photo,
+// whose caption is often empty or generic. In dry-run mode it always allows.
+func (f *MessageFilter) Allow(channel, text string, hasImage bool) bool {
+	if f == nil {
+		return true
+	}
+	reason := f.dropReason(channel, text, hasImage)
+	if reason == "" {
+		filterPassed.Add(channel, 1)
+		return true
+	}
+	if f.config.DryRun {
+		filterWouldDrop.Add(channel+":"+reason, 1)
+		log.Printf("Filter dry run: would drop message from %s (%s): %.80q", channel, reason, text)
+		return true
+	}
+	filterDropped.Add(channel+":"+reason, 1)
+	log.Printf("Filter dropped message from %s (%s)", channel, reason)
+	return false
+}
+
+// dropReason returns why the text should be dropped, or "" to keep it.
+func (f *MessageFilter) dropReason(channel, text string, hasImage bool) string {
+	for _, re := range f.config.spam {
+		if re.MatchString(text) {
+			return "spam"
+		}
+	}
+
+	rules, ok := f.config.Channels[channel]
+	if !ok {
+		rules = f.config.Default
+	}
+	if rules == nil {
+		return ""
+	}
+
+	lower := strings.ToLower(text)
+	for _, keyword := range rules.DenyKeywords {
+		if strings.Contains(lower, strings.ToLower(keyword)) {
+			return "deny"
+		}
+	}
+	for _, re := range rules.denyRegex {
+		if re.MatchString(text) {
+			return "deny"
+		}
+	}
+	if hasImage {
+		return ""
+	}
+
+	if utf8.RuneCountInString(text) < rules.MinLength {
+		return "short"
+	}
+	if len(rules.Languages) > 0 && !languageAllowed(detectLanguage(text), rules.Languages) {
+		return "language"
+	}
+	if len(rules.AllowKeywords) == 0 && len(rules.allowRegex) == 0 {
+		return ""
+	}
+	for _, keyword := range rules.AllowKeywords {
+		if strings.Contains(lower, strings.ToLower(keyword)) {
+			return ""
+		}
+	}
+	for _, re := range rules.allowRegex {
+		if re.MatchString(text) {
+			return ""
+		}
+	}
+	return "no-allow-match"
+}
+
+// detectLanguage tells Ukrainian, Russian and English apart by script and by the
+// letters unique to each Cyrillic alphabet. Cyrillic text without such letters
+// is "uk/ru"; text without enough letters is "".
+func detectLanguage(text string) string {
+	var cyrillic, latin, ukrainian, russian int
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case strings.ContainsRune("іїєґ", r):
+			ukrainian++
+			cyrillic++
+		case strings.ContainsRune("ыэъё", r):
+			russian++
+			cyrillic++
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+	switch {
+	case cyrillic+latin < 3:
+		return ""
+	case latin > cyrillic:
+		return "en"
+	case ukrainian > russian:
+		return "uk"
+	case russian > ukrainian:
+		return "ru"
+	default:
+		return "uk/ru"
+	}
+}
+
+// languageAllowed accepts undetermined text, and ambiguous Cyrillic when either
+// Ukrainian or Russian is allowed.
+func languageAllowed(language string, allowed []string) bool {
+	if language == "" {
+		return true
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == language || (language == "uk/ru" && (a == "uk" || a == "ru")) {
+			return true
+		}
+	}
+	return false
+}
+
+// startMetricsServer serves expvar metrics on /debug/vars when METRICS_ADDR is set.
+func startMetricsServer() {
+	addr := getEnv("METRICS_ADDR", "")
+	if addr == "" {
+		return
+	}
+	go func() {
+		log.Printf("Serving metrics on http://%s/debug/vars", addr)
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+}
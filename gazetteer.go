@@ -0,0 +1,274 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// gazetteerData is the bundled list of Odesa districts, neighbourhoods and
+// nearby settlements; GAZETTEER_FILE replaces it without a rebuild.
+//
+//go:embed data/gazetteer.json
+var gazetteerData []byte
+
+// maxAliasSuffix is how many letters a word may have beyond an alias stem, enough
+// for Ukrainian and Russian case endings ("Затока", "Затоку", "Затоці").
+const maxAliasSuffix = 3
+
+// minStemLength is the shortest alias word matched as a stem; shorter words such
+// as the prepositions "з" and "со" must match whole words.
+const minStemLength = 3
+
+// Location is one gazetteer entry. Aliases are lowercase stems in any language,
+// matched at the start of words; multi-word aliases match consecutive words.
+// Forms are matched as whole words only, for names whose stem would also match
+// common words or personal names, such as "аркади" and "Аркадий".
+type Location struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Kind is city, district, neighbourhood, settlement or direction
+	Kind string `json:"kind"`
+	// District is the Odesa city district the place belongs to, empty outside the city
+	District string `json:"district,omitempty"`
+	// Lat and Lon are approximate, zero for directions
+	Lat     float64  `json:"lat,omitempty"`
+	Lon     float64  `json:"lon,omitempty"`
+	Aliases []string `json:"aliases"`
+	Forms   []string `json:"forms,omitempty"`
+}
+
+// Label names the location with its district, e.g. "Люстдорф (Київський район)".
+func (l Location) Label() string {
+	if l.District == "" || l.Kind == "district" {
+		return l.Name
+	}
+	return fmt.Sprintf("%s (%s район)", l.Name, l.District)
+}
+
+type gazetteerAlias struct {
+	words    []string
+	location int
+	// exact aliases match whole words, without case endings
+	exact bool
+}
+
+// Gazetteer finds known places in message text. A nil gazetteer knows no places.
+type Gazetteer struct {
+	locations []Location
+	// aliases are sorted longest first, so "Великий Фонтан" wins over a shorter overlap
+	aliases []gazetteerAlias
+}
+
+// loadGazetteer reads GAZETTEER_FILE, or the bundled data when it is not set.
+func loadGazetteer() (*Gazetteer, error) {
+	data, source := gazetteerData, "bundled data"
+	if path := getEnv("GAZETTEER_FILE", ""); path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("error reading gazetteer: %v", err)
+		}
+		source = path
+	}
+
+	var locations []Location
+	if err := json.Unmarshal(data, &locations); err != nil {
+		return nil, fmt.Errorf("error parsing gazetteer %s: %v", source, err)
+	}
+	gazetteer, err := newGazetteer(locations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gazetteer %s: %v", source, err)
+	}
+	log.Printf("Loaded gazetteer from %s: %d location(s), %d alias(es)", source, len(locations), len(gazetteer.aliases))
+	return gazetteer, nil
+}
+
+func newGazetteer(locations []Location) (*Gazetteer, error) {
+	g := &Gazetteer{locations: locations}
+	ids := make(map[string]bool)
+	for i, location := range locations {
+		if location.ID == "" || location.Name == "" {
+			return nil, fmt.Errorf("location %d has no id or name", i+1)
+		}
+		if ids[location.ID] {
+			return nil, fmt.Errorf("duplicate location id %s", location.ID)
+		}
+		ids[location.ID] = true
+
+		for _, alias := range append([]string{location.Name}, location.Aliases...) {
+			words := locationWords(alias)
+			if len(words) == 0 {
+				return nil, fmt.Errorf("location %s has an empty alias", location.ID)
+			}
+			// A name with forms is matched by them only, its stem is too broad
+			exact := alias == location.Name && len(location.Forms) > 0
+			g.aliases = append(g.aliases, gazetteerAlias{words: words, location: i, exact: exact})
+		}
+		for _, form := range location.Forms {
+			words := locationWords(form)
+			if len(words) == 0 {
+				return nil, fmt.Errorf("location %s has an empty form", location.ID)
+			}
+			g.aliases = append(g.aliases, gazetteerAlias{words: words, location: i, exact: true})
+		}
+	}
+	sort.SliceStable(g.aliases, func(i, j int) bool {
+		return len(g.aliases[i].words) > len(g.aliases[j].words)
+	})
+	return g, nil
+}
+
+// locationWords lowercases the text and splits it into words. "р-н" is expanded
+// and ё folded, so the usual spellings meet the stems in the data file.
+func locationWords(text string) []string {
+	text = strings.ToLower(text)
+	text = strings.NewReplacer("р-н", "район", "ё", "е", "’", "'", "ʼ", "'").Replace(text)
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+}
+
+// wordMatches reports whether the word is the stem followed by at most a case
+// ending, or the same word for exact aliases and short stems.
+func wordMatches(word, stem string, exact bool) bool {
+	stemLength := utf8.RuneCountInString(stem)
+	if exact || stemLength < minStemLength {
+		return word == stem
+	}
+	return strings.HasPrefix(word, stem) && utf8.RuneCountInString(word)-stemLength <= maxAliasSuffix
+}
+
+// matchAt returns the location and word count of the longest alias starting at
+// words[i], or -1.
+func (g *Gazetteer) matchAt(words []string, i int) (int, int) {
+	for _, alias := range g.aliases {
+		if i+len(alias.words) > len(words) {
+			continue
+		}
+		matched := true
+		for j, stem := range alias.words {
+			if !wordMatches(words[i+j], stem, alias.exact) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return alias.location, len(alias.words)
+		}
+	}
+	return -1, 0
+}
+
+// Extract returns the places mentioned in the text in order of first mention.
+func (g *Gazetteer) Extract(text string) []Location {
+	if g == nil {
+		return nil
+	}
+	words := locationWords(text)
+	seen := make(map[int]bool)
+	var found []Location
+	for i := 0; i < len(words); {
+		location, length := g.matchAt(words, i)
+		if location < 0 {
+			i++
+			continue
+		}
+		if !seen[location] {
+			seen[location] = true
+			found = append(found, g.locations[location])
+		}
+		i += length
+	}
+	return found
+}
+
+// Places returns the places mentioned in the text except the city itself, which
+// nearly every message names and which would only add noise to the batch.
+func (g *Gazetteer) Places(text string) []Location {
+	var places []Location
+	for _, location := range g.Extract(text) {
+		if location.Kind != "city" {
+			places = append(places, location)
+		}
+	}
+	return places
+}
+
+// Locations returns every gazetteer entry.
+func (g *Gazetteer) Locations() []Location {
+	if g == nil {
+		return nil
+	}
+	return g.locations
+}
+
+// Resolve maps a place name returned by the AI to its gazetteer entry. Besides
+// the aliases, a bare district name such as "Київський" is accepted.
+func (g *Gazetteer) Resolve(name string) (Location, bool) {
+	if g == nil {
+		return Location{}, false
+	}
+	if found := g.Extract(name); len(found) > 0 {
+		return found[0], true
+	}
+	for _, location := range g.locations {
+		if location.Kind == "district" && strings.EqualFold(strings.TrimSpace(name), location.District) {
+			return location, true
+		}
+	}
+	return Location{}, false
+}
+
+// locationNames returns the names of the locations, as stored on a Message.
+func locationNames(locations []Location) []string {
+	var names []string
+	for _, location := range locations {
+		names = append(names, location.Name)
+	}
+	return names
+}
+
+// locationNote tells the model which known places a post mentions, e.g.
+// "[places: Люстдорф (Київський район), з моря]".
+func locationNote(locations []Location) string {
+	if len(locations) == 0 {
+		return ""
+	}
+	labels := make([]string, len(locations))
+	for i, location := range locations {
+		labels[i] = location.Label()
+	}
+	return "\n[places: " + strings.Join(labels, ", ") + "]"
+}
+
+// checkLocations replaces the place names of a response with their gazetteer
+// names. Unknown names are logged and kept, or dropped when drop is set.
+func (g *Gazetteer) checkLocations(names []string, drop bool) []string {
+	if g == nil {
+		return names
+	}
+	var checked []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		location, ok := g.Resolve(name)
+		if !ok {
+			if drop {
+				log.Printf("Dropping unknown location %q from AI response", name)
+				continue
+			}
+			log.Printf("AI response names unknown location %q", name)
+			location.Name = name
+		}
+		if !seen[location.Name] {
+			seen[location.Name] = true
+			checked = append(checked, location.Name)
+		}
+	}
+	return checked
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func bundledGazetteer(t *testing.T) *Gazetteer {
+	t.Helper()
+	t.Setenv("GAZETTEER_FILE", "")
+	gazetteer, err := loadGazetteer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gazetteer
+}
+
+func TestGazetteerPlaces(t *testing.T) {
+	gazetteer := bundledGazetteer(t)
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Шахеди над Затокою, курс на Одесу", []string{"Затока"}},
+		{"Вибухи в Аркадії та на Великому Фонтані", []string{"Аркадія", "Великий Фонтан"}},
+		{"Взрывы в районе Большого Фонтана", []string{"Великий Фонтан"}},
+		{"Загроза з моря для Чорноморська", []string{"з моря", "Чорноморськ"}},
+		{"Київський р-н, Люстдорф", []string{"Київський район", "Люстдорф"}},
+		// Personal names and the region must not match places
+		{"Аркадій Петрович повідомив про Одеську область", nil},
+		{"Аркадий, прием", nil},
+		{"Мер Одеси Таїров", nil},
+		{"Вибух на вул. Котовського", nil},
+		{"Ракета со стороны моря на поселок Котовского", []string{"з моря", "Селище Котовського"}},
+		{"Удар по селищу Котовського", []string{"Селище Котовського"}},
+		// Short prepositions match only as whole words of the phrase
+		{"Шахеди з моря", []string{"з моря"}},
+		{"Держава с морями и горами", nil},
+		{"Зараз морями не ходять", nil},
+		// The city alone gives no note
+		{"Тиша в Одесі", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got := locationNames(gazetteer.Places(tt.text))
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Fatalf("Places = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if found := gazetteer.Extract("Тиша в Одесі"); len(found) != 1 || found[0].Kind != "city" {
+		t.Fatalf("Extract should still find the city, got %+v", found)
+	}
+}
+
+func TestGazetteerCheckLocations(t *testing.T) {
+	gazetteer := bundledGazetteer(t)
+	tests := []struct {
+		names []string
+		drop  bool
+		want  []string
+	}{
+		{[]string{"Затоку", "затока", "Київський"}, false, []string{"Затока", "Київський район"}},
+		{[]string{"Аркадия", "Марс"}, false, []string{"Аркадія", "Марс"}},
+		{[]string{"Аркадия", "Марс"}, true, []string{"Аркадія"}},
+	}
+	for _, tt := range tests {
+		got := gazetteer.checkLocations(tt.names, tt.drop)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("checkLocations(%q, %v) = %q, want %q", tt.names, tt.drop, got, tt.want)
+		}
+	}
+}
+
+func TestLocationNote(t *testing.T) {
+	gazetteer := bundledGazetteer(t)
+	if note := locationNote(gazetteer.Places("Тиша в Одесі")); note != "" {
+		t.Fatalf("note for the city only = %q, want none", note)
+	}
+	want := "\n[places: Люстдорф (Київський район), з моря]"
+	if note := locationNote(gazetteer.Places("Люстдорф, з моря")); note != want {
+		t.Fatalf("note = %q, want %q", note, want)
+	}
+}
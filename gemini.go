@@ -1,40 +1,89 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"strings"
-	"time"
 )
 
+// geminiModel is the default Gemini model, override with GEMINI_MODEL
+const geminiModel = "gemini-3-flash-preview"
+
+// geminiUsage is the usageMetadata of a generateContent response. Thinking
+// tokens are billed as output.
+type geminiUsage struct {
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount"`
+	PromptTokensDetails     []struct {
+		Modality   string `json:"modality"`
+		TokenCount int    `json:"tokenCount"`
+	} `json:"promptTokensDetails"`
+}
+
+func (u geminiUsage) tokenUsage() TokenUsage {
+	usage := TokenUsage{
+		Prompt:     u.PromptTokenCount,
+		Completion: u.CandidatesTokenCount + u.ThoughtsTokenCount,
+		Cached:     u.CachedContentTokenCount,
+	}
+	for _, detail := range u.PromptTokensDetails {
+		if detail.Modality == "IMAGE" {
+			usage.Image += detail.TokenCount
+		}
+	}
+	return usage
+}
+
 // AddMessageToHistory adds a message to the client's history, maintaining max history size.
 func (c *GeminiClient) AddMessageToHistory(message Message) {
-	c.MessageHistory = append(c.MessageHistory, message)
-	if len(c.MessageHistory) > maxMessageHistory {
-		c.MessageHistory = c.MessageHistory[1:] // Remove the oldest message
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = appendHistory(c.MessageHistory, message, c.History)
 }
 
-// GetMessageHistory returns the current message history.
+// GetMessageHistory returns a copy of the current message history.
 func (c *GeminiClient) GetMessageHistory() []Message {
-	return c.MessageHistory
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return copyHistory(c.MessageHistory)
+}
+
+// SetSystemMessage replaces the system message used for subsequent requests.
+func (c *GeminiClient) SetSystemMessage(systemMessage string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SystemMessage = systemMessage
+}
+
+// ForgetRepair removes a validation repair exchange from the history.
+func (c *GeminiClient) ForgetRepair(request string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = withoutRepair(c.MessageHistory, request)
 }
 
 // SendMessage sends the current message history to the Gemini API and returns the AI's response.
 func (c *GeminiClient) SendMessage(ctx context.Context, message Message) (AIJSONResponse, error) {
+	// Requests on one client are serialized so the conversation stays in order
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
 	// Add user message to history at the beginning
 	c.AddMessageToHistory(message)
-
-	// Note: Adjust the model name as needed (e.g., "gemini-1.5-flash-latest", "gemini-1.5-pro-latest")
-	// See https://ai.google.dev/gemini-api/docs/models/gemini
-	// model := "gemini-2.5-pro-exp-03-25"
-	model := "gemini-3-flash-preview"
-	url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent?key=%s", model, c.APIKey)
+	history := prepareHistory(ctx, &c.mu, &c.MessageHistory, c.History, "gemini")
+	c.mu.Lock()
+	systemMessage := c.SystemMessage
+	c.mu.Unlock()
+
+	// The model is configured with GEMINI_MODEL, see https://ai.google.dev/gemini-api/docs/models/gemini
+	model, textOnly := c.Usage.SelectModel("gemini", c.Model, c.FallbackModel)
+	if textOnly {
+		history = withoutImages(history)
+	}
+	url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent", model)
 
 	// Construct Gemini API request payload
 	// Gemini API expects alternating user/model roles
@@ -42,17 +91,17 @@ func (c *GeminiClient) SendMessage(ctx context.Context, message Message) (AIJSON
 	var contents []map[string]interface{}
 
 	// Start with system message if present
-	if c.SystemMessage != "" {
+	if systemMessage != "" {
 		contents = append(contents, map[string]interface{}{
 			"role": "user",
 			"parts": []map[string]interface{}{
-				{"text": c.SystemMessage + "\n Текущее время: " + time.Now().Format("15:04:05")},
+				{"text": c.Prompt.Render(systemMessage).String()},
 			},
 		})
 	}
 
 	// Add historical messages
-	for _, msg := range c.MessageHistory {
+	for _, msg := range history {
 		// Map our roles to Gemini's roles (user and model)
 		role := msg.Role
 		if role == "assistant" {
@@ -96,7 +145,9 @@ func (c *GeminiClient) SendMessage(ctx context.Context, message Message) (AIJSON
 
 	// Main request configuration
 	generationConfig := map[string]interface{}{
-		"thinkingConfig": thinkingConfig,
+		"thinkingConfig":   thinkingConfig,
+		"responseMimeType": "application/json",
+		"responseSchema":   geminiSchema(aiResponseSchema()),
 		// Other config options can go here
 		// "temperature": 0.7,
 		// "topP": 1.0,
@@ -116,84 +167,70 @@ func (c *GeminiClient) SendMessage(ctx context.Context, message Message) (AIJSON
 
 	// log.Printf("Gemini Request Body: %s", string(reqBody)) // Log the request body for debugging (be careful with large images)
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
-	if err != nil {
-		return AIJSONResponse{}, fmt.Errorf("failed to create gemini request: %w", err)
-	}
+	// The key is sent as a header so it does not leak into logged transport errors
+	headers := map[string]string{"x-goog-api-key": c.APIKey}
 
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return AIJSONResponse{}, fmt.Errorf("failed to send request to gemini: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return AIJSONResponse{}, fmt.Errorf("failed to read gemini response body: %w", err)
-	}
-
-	log.Printf("Gemini Raw Response: %s", string(body)) // Log raw response
+	var aiResp AIJSONResponse
+	err = c.Retry.Do(ctx, "gemini", func(ctx context.Context) error {
+		body, err := postJSON(ctx, c.HTTPClient, "gemini", url, headers, reqBody)
+		if err != nil {
+			return err
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		return AIJSONResponse{}, fmt.Errorf("gemini API request failed with status %d: %s", resp.StatusCode, string(body))
-	}
+		log.Printf("Gemini Raw Response: %s", string(body)) // Log raw response
+
+		// Parse the Gemini response structure
+		var geminiResp struct {
+			Candidates []struct {
+				Content struct {
+					Parts []struct {
+						Text string `json:"text"`
+					} `json:"parts"`
+					Role string `json:"role"`
+				} `json:"content"`
+			} `json:"candidates"`
+			// PromptFeedback can be checked for safety blocks
+			PromptFeedback *struct {
+				BlockReason string `json:"blockReason"`
+				// SafetyRatings can also be included
+			} `json:"promptFeedback"`
+			UsageMetadata geminiUsage `json:"usageMetadata"`
+		}
 
-	// Parse the Gemini response structure
-	var geminiResp struct {
-		Candidates []struct {
-			Content struct {
-				Parts []struct {
-					Text string `json:"text"`
-				} `json:"parts"`
-				Role string `json:"role"`
-			} `json:"content"`
-		} `json:"candidates"`
-		// PromptFeedback can be checked for safety blocks
-		PromptFeedback *struct {
-			BlockReason string `json:"blockReason"`
-			// SafetyRatings can also be included
-		} `json:"promptFeedback"`
-	}
+		if err := json.Unmarshal(body, &geminiResp); err != nil {
+			return malformed(fmt.Errorf("failed to unmarshal gemini response: %w body: %s", err, string(body)))
+		}
+		c.Usage.Record("gemini", model, geminiResp.UsageMetadata.tokenUsage())
 
-	if err := json.Unmarshal(body, &geminiResp); err != nil {
-		return AIJSONResponse{}, fmt.Errorf("failed to unmarshal gemini response: %w body: %s", err, string(body))
-	}
+		// Check for prompt feedback indicating blockage
+		if geminiResp.PromptFeedback != nil && geminiResp.PromptFeedback.BlockReason != "" {
+			log.Printf("Gemini request blocked, reason: %s", geminiResp.PromptFeedback.BlockReason)
+			return fmt.Errorf("gemini request blocked due to safety settings: %s", geminiResp.PromptFeedback.BlockReason)
+		}
 
-	// Check for prompt feedback indicating blockage
-	if geminiResp.PromptFeedback != nil && geminiResp.PromptFeedback.BlockReason != "" {
-		log.Printf("Gemini request blocked, reason: %s", geminiResp.PromptFeedback.BlockReason)
-		return AIJSONResponse{}, fmt.Errorf("gemini request blocked due to safety settings: %s", geminiResp.PromptFeedback.BlockReason)
-	}
+		// Extract the text content and attempt to unmarshal it into our AIJSONResponse
+		if len(geminiResp.Candidates) == 0 || len(geminiResp.Candidates[0].Content.Parts) == 0 {
+			log.Printf("No valid content found in Gemini response: %+v", geminiResp)
+			return malformed(fmt.Errorf("no valid content found in gemini response"))
+		}
 
-	// Extract the text content and attempt to unmarshal it into our AIJSONResponse
-	if len(geminiResp.Candidates) > 0 && len(geminiResp.Candidates[0].Content.Parts) > 0 {
 		responseText := geminiResp.Candidates[0].Content.Parts[0].Text
 		log.Printf("Gemini Response Text (before JSON parse): %s", responseText) // Log the text part
 
-		// Clean and parse the content
-		responseText = strings.TrimSpace(responseText)
-		responseText = strings.TrimPrefix(responseText, "```json")
-		responseText = strings.TrimPrefix(responseText, "```yaml")
-		responseText = strings.TrimPrefix(responseText, "```")
-		responseText = strings.TrimSuffix(responseText, "```")
-		responseText = strings.TrimSpace(responseText)
-
-		var aiResp AIJSONResponse
-		// The response text itself should be the JSON string we expect
-		if err := json.Unmarshal([]byte(responseText), &aiResp); err != nil {
-			log.Printf("Failed to unmarshal inner JSON from Gemini response: %v. Response text: %s", err, responseText)
-			// Fallback or error handling if the inner text isn't the expected JSON
-			return AIJSONResponse{}, fmt.Errorf("failed to unmarshal inner JSON from gemini response: %w. Content was: %s", err, responseText)
+		// responseSchema should make the text plain JSON, the extractor covers models that still wrap it
+		aiResp, err = parseAIJSON(responseText)
+		if err != nil {
+			log.Printf("Failed to parse JSON from Gemini response: %v", err)
+			return malformed(fmt.Errorf("failed to parse JSON from gemini response: %w", err))
 		}
-
-		// Add the successful AI response to history (as 'model') - matching ChatGPT implementation format
-		c.AddMessageToHistory(Message{Role: "assistant", Content: fmt.Sprintf("%s Danger: %v StatusChanged: %v", aiResp.Text, aiResp.Danger, aiResp.StatusChanged)})
-
-		return aiResp, nil
+		return nil
+	})
+	if err != nil {
+		return AIJSONResponse{}, err
 	}
 
-	log.Printf("No valid content found in Gemini response: %+v", geminiResp)
-	return AIJSONResponse{}, fmt.Errorf("no valid content found in gemini response")
+	// Add the successful AI response to history (as 'model') - matching ChatGPT implementation format
+	c.AddMessageToHistory(Message{Role: "assistant", Content: fmt.Sprintf("%s Danger: %v StatusChanged: %v", aiResp.Text, aiResp.Danger, aiResp.StatusChanged)})
+
+	return aiResp, nil
 }
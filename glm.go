@@ -6,11 +6,9 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"strings"
-	"time"
+	"sync"
 )
 
 // GLMClient implements the AIClient interface for Z.AI's GLM model.
@@ -19,10 +17,19 @@ import (
 type GLMClient struct {
 	APIKey         string
 	HTTPClient     *http.Client
+	Retry          RetryPolicy
+	History        HistoryPolicy
 	SystemMessage  string
 	MessageHistory []Message
 	// UseCodingPlan indicates whether to use the GLM Coding Plan endpoint
 	UseCodingPlan bool
+	Model         string
+	FallbackModel string
+	Usage         *UsageTracker
+	Prompt        *PromptState
+	// mu guards SystemMessage and MessageHistory; sendMu serializes SendMessage calls
+	mu     sync.Mutex
+	sendMu sync.Mutex
 }
 
 // GLM API configuration
@@ -31,27 +38,55 @@ const (
 	glmAPIEndpoint = "https://api.z.ai/api/paas/v4/chat/completions"
 	// GLM Coding Plan endpoint (for subscribers)
 	glmCodingAPIEndpoint = "https://api.z.ai/api/coding/paas/v4/chat/completions"
-	// Model identifier
+	// Default model identifier, override with GLM_MODEL
 	glmModel = "glm-5"
 )
 
 // AddMessageToHistory adds a message to the client's history, maintaining max history size.
 func (c *GLMClient) AddMessageToHistory(message Message) {
-	c.MessageHistory = append(c.MessageHistory, message)
-	if len(c.MessageHistory) > maxMessageHistory {
-		c.MessageHistory = c.MessageHistory[1:] // Remove the oldest message
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = appendHistory(c.MessageHistory, message, c.History)
 }
 
-// GetMessageHistory returns the current message history.
+// GetMessageHistory returns a copy of the current message history.
 func (c *GLMClient) GetMessageHistory() []Message {
-	return c.MessageHistory
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return copyHistory(c.MessageHistory)
+}
+
+// SetSystemMessage replaces the system message used for subsequent requests.
+func (c *GLMClient) SetSystemMessage(systemMessage string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SystemMessage = systemMessage
+}
+
+// ForgetRepair removes a validation repair exchange from the history.
+func (c *GLMClient) ForgetRepair(request string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = withoutRepair(c.MessageHistory, request)
 }
 
 // SendMessage sends the current message history to the GLM API and returns the AI's response.
 func (c *GLMClient) SendMessage(ctx context.Context, message Message) (AIJSONResponse, error) {
+	// Requests on one client are serialized so the conversation stays in order
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
 	// Add user message to history at the beginning
 	c.AddMessageToHistory(message)
+	history := prepareHistory(ctx, &c.mu, &c.MessageHistory, c.History, "glm")
+	c.mu.Lock()
+	systemMessage := c.SystemMessage
+	c.mu.Unlock()
+
+	model, textOnly := c.Usage.SelectModel("glm", c.Model, c.FallbackModel)
+	if textOnly {
+		history = withoutImages(history)
+	}
 
 	// Always use the general API endpoint.
 	// Note: The Coding Plan endpoint (glmCodingAPIEndpoint) is for coding tools only
@@ -65,15 +100,15 @@ func (c *GLMClient) SendMessage(ctx context.Context, message Message) (AIJSONRes
 	var apiMessages []map[string]interface{}
 
 	// Add system message first
-	if c.SystemMessage != "" {
+	if systemMessage != "" {
 		apiMessages = append(apiMessages, map[string]interface{}{
 			"role":    "system",
-			"content": c.SystemMessage + "\n Current time: " + time.Now().Format("15:04:05"),
+			"content": c.Prompt.Render(systemMessage).String() + "\n" + schemaInstruction(),
 		})
 	}
 
 	// Add historical messages
-	for _, msg := range c.MessageHistory {
+	for _, msg := range history {
 		role := msg.Role
 		// GLM uses "assistant" role (like OpenAI), not "model" like Gemini
 
@@ -126,11 +161,13 @@ func (c *GLMClient) SendMessage(ctx context.Context, message Message) (AIJSONRes
 	// Build request body
 	// Reference: https://docs.z.ai/guides/overview/migrate-to-glm-new
 	reqBodyMap := map[string]interface{}{
-		"model":       glmModel,
+		"model":       model,
 		"messages":    apiMessages,
 		"temperature": 1.0,  // Recommended default for GLM
 		"max_tokens":  4096, // Reasonable default
 		"thinking":    map[string]interface{}{"type": "enabled"},
+		// GLM supports JSON mode but not schemas; the schema is described in the system prompt
+		"response_format": responseFormat{Type: "json_object"},
 	}
 
 	reqBody, err := json.Marshal(reqBodyMap)
@@ -140,93 +177,69 @@ func (c *GLMClient) SendMessage(ctx context.Context, message Message) (AIJSONRes
 
 	// log.Printf("GLM Request Body: %s", string(reqBody)) // Debug logging
 
-	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(reqBody))
-	if err != nil {
-		return AIJSONResponse{}, fmt.Errorf("failed to create GLM request: %w", err)
-	}
-
-	// Set required headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
-	req.Header.Set("Accept-Language", "en-US,en") // Optional: for English responses
-
-	resp, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return AIJSONResponse{}, fmt.Errorf("failed to send request to GLM: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return AIJSONResponse{}, fmt.Errorf("failed to read GLM response body: %w", err)
-	}
-
-	log.Printf("GLM Raw Response: %s", string(body)) // Log raw response
-
-	if resp.StatusCode != http.StatusOK {
-		return AIJSONResponse{}, fmt.Errorf("GLM API request failed with status %d: %s", resp.StatusCode, string(body))
+	headers := map[string]string{
+		"Authorization":   fmt.Sprintf("Bearer %s", c.APIKey),
+		"Accept-Language": "en-US,en", // Optional: for English responses
 	}
 
-	// Parse the OpenAI-compatible response structure
-	var glmResp struct {
-		Choices []struct {
-			Message struct {
-				Role    string `json:"role"`
-				Content string `json:"content"`
-			} `json:"message"`
-			FinishReason string `json:"finish_reason"`
-		} `json:"choices"`
-		Error struct {
-			Message string `json:"message"`
-			Type    string `json:"type"`
-			Code    string `json:"code"`
-		} `json:"error"`
-		Usage struct {
-			PromptTokens     int `json:"prompt_tokens"`
-			CompletionTokens int `json:"completion_tokens"`
-			TotalTokens      int `json:"total_tokens"`
-		} `json:"usage"`
-	}
+	var aiResp AIJSONResponse
+	err = c.Retry.Do(ctx, "GLM", func(ctx context.Context) error {
+		body, err := postJSON(ctx, c.HTTPClient, "GLM", endpoint, headers, reqBody)
+		if err != nil {
+			return err
+		}
 
-	// Handle UTF-8 BOM if present
-	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+		log.Printf("GLM Raw Response: %s", string(body)) // Log raw response
+
+		// Parse the OpenAI-compatible response structure
+		var glmResp struct {
+			Choices []struct {
+				Message struct {
+					Role    string `json:"role"`
+					Content string `json:"content"`
+				} `json:"message"`
+				FinishReason string `json:"finish_reason"`
+			} `json:"choices"`
+			Error struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+				Code    string `json:"code"`
+			} `json:"error"`
+			Usage openAIUsage `json:"usage"`
+		}
 
-	if err := json.Unmarshal(body, &glmResp); err != nil {
-		return AIJSONResponse{}, fmt.Errorf("failed to unmarshal GLM response: %w body: %s", err, string(body))
-	}
+		// Handle UTF-8 BOM if present
+		body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
 
-	// Check for API error
-	if glmResp.Error.Message != "" {
-		return AIJSONResponse{}, fmt.Errorf("GLM API error: %s (type: %s, code: %s)",
-			glmResp.Error.Message, glmResp.Error.Type, glmResp.Error.Code)
-	}
+		if err := json.Unmarshal(body, &glmResp); err != nil {
+			return malformed(fmt.Errorf("failed to unmarshal GLM response: %w body: %s", err, string(body)))
+		}
 
-	// Extract the response content
-	if len(glmResp.Choices) == 0 {
-		return AIJSONResponse{}, fmt.Errorf("no choices in GLM response")
-	}
+		// Check for API error
+		if glmResp.Error.Message != "" {
+			return fmt.Errorf("GLM API error: %s (type: %s, code: %s)",
+				glmResp.Error.Message, glmResp.Error.Type, glmResp.Error.Code)
+		}
 
-	responseText := glmResp.Choices[0].Message.Content
-	log.Printf("GLM Response Text (before JSON parse): %s", responseText)
+		// Extract the response content
+		if len(glmResp.Choices) == 0 {
+			return malformed(fmt.Errorf("no choices in GLM response"))
+		}
 
-	// Log token usage
-	if glmResp.Usage.TotalTokens > 0 {
-		log.Printf("GLM Token Usage - Prompt: %d, Completion: %d, Total: %d",
-			glmResp.Usage.PromptTokens, glmResp.Usage.CompletionTokens, glmResp.Usage.TotalTokens)
-	}
+		responseText := glmResp.Choices[0].Message.Content
+		log.Printf("GLM Response Text (before JSON parse): %s", responseText)
 
-	// Clean and parse the content (same as other providers)
-	responseText = strings.TrimSpace(responseText)
-	responseText = strings.TrimPrefix(responseText, "```json")
-	responseText = strings.TrimPrefix(responseText, "```yaml")
-	responseText = strings.TrimPrefix(responseText, "```")
-	responseText = strings.TrimSuffix(responseText, "```")
-	responseText = strings.TrimSpace(responseText)
+		c.Usage.Record("glm", model, glmResp.Usage.tokenUsage(history, "glm"))
 
-	var aiResp AIJSONResponse
-	if err := json.Unmarshal([]byte(responseText), &aiResp); err != nil {
-		log.Printf("Failed to unmarshal inner JSON from GLM response: %v. Response text: %s", err, responseText)
-		return AIJSONResponse{}, fmt.Errorf("failed to unmarshal inner JSON from GLM response: %w. Content was: %s", err, responseText)
+		aiResp, err = parseAIJSON(responseText)
+		if err != nil {
+			log.Printf("Failed to parse JSON from GLM response: %v", err)
+			return malformed(fmt.Errorf("failed to parse JSON from GLM response: %w", err))
+		}
+		return nil
+	})
+	if err != nil {
+		return AIJSONResponse{}, err
 	}
 
 	// Add the successful AI response to history
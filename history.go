@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// summaryPrefix opens the situation summary message kept at the head of the history.
+const summaryPrefix = "Situation summary of earlier messages:\n"
+
+// HistoryPolicy limits how much conversation history is replayed to a provider.
+type HistoryPolicy struct {
+	// MaxMessages caps the number of stored messages
+	MaxMessages int
+	// TokenBudget is the estimated token budget for the replayed history, 0 disables it
+	TokenBudget int
+	// ImageTurns is the number of most recent user turns that keep their images;
+	// older images are replaced with a text placeholder. Negative keeps all images.
+	ImageTurns int
+	// Summarizer, when set, folds evicted turns into a situation summary instead of discarding them
+	Summarizer HistorySummarizer
+}
+
+// HistorySummarizer compresses messages evicted from the history into a running summary.
+type HistorySummarizer interface {
+	Summarize(ctx context.Context, previous string, evicted []Message) (string, error)
+}
+
+func loadHistoryPolicy() HistoryPolicy {
+	return HistoryPolicy{
+		MaxMessages: envInt("AI_HISTORY_MAX_MESSAGES", maxMessageHistory),
+		TokenBudget: envInt("AI_HISTORY_TOKEN_BUDGET", 32000),
+		ImageTurns:  envInt("AI_HISTORY_IMAGE_TURNS", 2),
+	}
+}
+
+func (p HistoryPolicy) maxMessages() int {
+	if p.MaxMessages > 0 {
+		return p.MaxMessages
+	}
+	return maxMessageHistory
+}
+
+// appendHistory appends a message and drops the oldest messages above the message cap.
+// With a summarizer configured trimming is left to Enforce, which runs before every
+// request and can summarize what it evicts.
+func appendHistory(history []Message, message Message, policy HistoryPolicy) []Message {
+	if message.Time.IsZero() {
+		message.Time = time.Now()
+	}
+	history = append(history, message)
+	if policy.Summarizer != nil {
+		return history
+	}
+	if excess := len(history) - policy.maxMessages(); excess > 0 {
+		history = history[excess:]
+	}
+	return history
+}
+
+// Enforce applies the policy before a request: images in old turns are replaced
+// with placeholders, then the oldest messages are dropped until the history fits
+// the message cap and token budget. The newest message is always kept. Dropped
+// messages are folded into the situation summary at the head when a summarizer is set.
+func (p HistoryPolicy) Enforce(ctx context.Context, history []Message, provider string) []Message {
+	history = p.stripOldImages(history)
+
+	var summary *Message
+	if len(history) > 0 && history[0].Summary {
+		head := history[0]
+		summary = &head
+		history = history[1:]
+	}
+
+	var evicted []Message
+	if excess := len(history) - p.maxMessages(); excess > 0 {
+		evicted = append(evicted, history[:excess]...)
+		history = history[excess:]
+	}
+
+	if p.TokenBudget > 0 {
+		total := 0
+		if summary != nil {
+			total += estimateMessageTokens(*summary, provider)
+		}
+		for _, msg := range history {
+			total += estimateMessageTokens(msg, provider)
+		}
+		dropped := 0
+		for total > p.TokenBudget && len(history) > 1 {
+			total -= estimateMessageTokens(history[0], provider)
+			evicted = append(evicted, history[0])
+			history = history[1:]
+			dropped++
+		}
+		if dropped > 0 {
+			log.Printf("History over token budget for %s, dropped %d oldest message(s), ~%d tokens remain", provider, dropped, total)
+		}
+	}
+
+	// Providers expect the conversation to open with a user turn
+	for len(history) > 1 && history[0].Role != "user" {
+		evicted = append(evicted, history[0])
+		history = history[1:]
+	}
+
+	if len(evicted) > 0 && p.Summarizer != nil {
+		summary = p.summarize(ctx, summary, evicted, provider)
+	}
+	if summary != nil {
+		history = append([]Message{*summary}, history...)
+	}
+	return history
+}
+
+// summarize folds evicted messages into the summary. On failure the previous
+// summary is kept and the evicted messages are lost, as they would be without a summarizer.
+func (p HistoryPolicy) summarize(ctx context.Context, summary *Message, evicted []Message, provider string) *Message {
+	previous := ""
+	if summary != nil {
+		previous = strings.TrimPrefix(summary.Content, summaryPrefix)
+	}
+
+	text, err := p.Summarizer.Summarize(ctx, previous, evicted)
+	if err != nil {
+		log.Printf("Error summarizing %d evicted message(s) for %s: %v", len(evicted), provider, err)
+		return summary
+	}
+	log.Printf("Summarized %d evicted message(s) for %s", len(evicted), provider)
+	return &Message{Role: "user", Content: summaryPrefix + text, Summary: true, Time: time.Now()}
+}
+
+// stripOldImages replaces images outside the last ImageTurns user turns with a
+// placeholder. Messages are copied, the caller's slice elements are not modified.
+func (p HistoryPolicy) stripOldImages(history []Message) []Message {
+	if p.ImageTurns < 0 {
+		return history
+	}
+
+	userTurns := 0
+	var stripped []Message
+	for i := len(history) - 1; i >= 0; i-- {
+		msg := history[i]
+		if msg.Role != "user" || msg.Summary {
+			continue
+		}
+		userTurns++
+		if userTurns <= p.ImageTurns || len(msg.Images) == 0 {
+			continue
+		}
+		if stripped == nil {
+			stripped = make([]Message, len(history))
+			copy(stripped, history)
+		}
+		msg.Content = fmt.Sprintf("%s\n[%d image(s) from this earlier turn omitted]", msg.Content, len(msg.Images))
+		msg.Images = nil
+		stripped[i] = msg
+	}
+
+	if stripped == nil {
+		return history
+	}
+	return stripped
+}
+
+// copyHistory returns a copy of the history so callers never share the client's backing array.
+func copyHistory(history []Message) []Message {
+	return append([]Message(nil), history...)
+}
+
+// repairForgetter is implemented by clients that can remove a validation repair
+// exchange from their history.
+type repairForgetter interface {
+	ForgetRepair(request string)
+}
+
+// withoutRepair removes the latest repair request with the given content. When the
+// model answered it, the rejected answer before the request goes too, so the
+// repaired answer directly follows the batch it answers and turns keep alternating.
+func withoutRepair(history []Message, request string) []Message {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role != "user" || history[i].Content != request {
+			continue
+		}
+		from := i
+		answered := i+1 < len(history) && history[i+1].Role == "assistant"
+		if answered && i > 0 && history[i-1].Role == "assistant" {
+			from = i - 1
+		}
+		return append(copyHistory(history[:from]), history[i+1:]...)
+	}
+	return history
+}
+
+// prepareHistory enforces the policy on a client's history and returns the messages
+// to send. The history is read and written under mu, but enforcement runs unlocked
+// because it may call the summarizer; messages appended meanwhile are kept.
+func prepareHistory(ctx context.Context, mu *sync.Mutex, history *[]Message, policy HistoryPolicy, provider string) []Message {
+	mu.Lock()
+	snapshot := copyHistory(*history)
+	mu.Unlock()
+
+	enforced := policy.Enforce(ctx, snapshot, provider)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(*history) > len(snapshot) {
+		enforced = append(enforced, (*history)[len(snapshot):]...)
+	}
+	*history = copyHistory(enforced)
+	return enforced
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultHistoryDir = "config/history"
+
+// HistoryStore persists conversation histories across restarts.
+type HistoryStore interface {
+	// Load returns the saved history of a client, dropping messages older than maxAge (0 keeps all).
+	Load(name string, maxAge time.Duration) ([]Message, error)
+	// Save replaces the saved history of a client.
+	Save(name string, history []Message) error
+	// LoadPromptArm returns the prompt split arm the client's history was built with, nil when none is saved.
+	LoadPromptArm(name string) (*PromptArm, error)
+	// SavePromptArm replaces the saved prompt split arm of a client.
+	SavePromptArm(name string, arm PromptArm) error
+}
+
+// FileHistoryStore keeps one JSON file per client in Dir. Images are written once
+// to Dir/images under their SHA-256 and referenced by hash from the history files.
+type FileHistoryStore struct {
+	Dir string
+}
+
+// storedMessage is the on-disk form of a Message. Shingles are not kept, they
+// only matter while a message waits in the batch buffer.
+type storedMessage struct {
+	Role      string          `json:"role"`
+	Content   string          `json:"content"`
+	Summary   bool            `json:"summary,omitempty"`
+	Time      time.Time       `json:"time"`
+	Images    []storedImage   `json:"images,omitempty"`
+	Sources   []MessageSource `json:"sources,omitempty"`
+	Locations []string        `json:"locations,omitempty"`
+}
+
+// storedImage references an image file by content hash.
+type storedImage struct {
+	Hash     string `json:"hash"`
+	MIMEType string `json:"mimeType"`
+}
+
+func loadHistoryStore() HistoryStore {
+	switch strings.ToLower(getEnv("HISTORY_STORE", "file")) {
+	case "file":
+		return &FileHistoryStore{Dir: getEnv("HISTORY_DIR", defaultHistoryDir)}
+	case "none", "":
+		return nil
+	default:
+		log.Printf("Unknown HISTORY_STORE '%s', history will not be persisted", getEnv("HISTORY_STORE", ""))
+		return nil
+	}
+}
+
+func (s *FileHistoryStore) historyPath(name string) string {
+	return filepath.Join(s.Dir, name+".json")
+}
+
+// promptArmPath is not a .json file, so pruneImages does not read it as a history.
+func (s *FileHistoryStore) promptArmPath(name string) string {
+	return filepath.Join(s.Dir, name+".prompt")
+}
+
+func (s *FileHistoryStore) imageDir() string {
+	return filepath.Join(s.Dir, "images")
+}
+
+// Load implements HistoryStore. Messages whose image files are missing are kept without the images.
+func (s *FileHistoryStore) Load(name string, maxAge time.Duration) ([]Message, error) {
+	data, err := os.ReadFile(s.historyPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading history file: %w", err)
+	}
+
+	var stored []storedMessage
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("error parsing history file: %w", err)
+	}
+
+	var history []Message
+	for _, sm := range stored {
+		// The summary describes everything before it, so it is kept regardless of age
+		if maxAge > 0 && !sm.Summary && time.Since(sm.Time) > maxAge {
+			continue
+		}
+		msg := Message{Role: sm.Role, Content: sm.Content, Summary: sm.Summary, Time: sm.Time, Sources: sm.Sources, Locations: sm.Locations}
+		for _, ref := range sm.Images {
+			imgData, err := os.ReadFile(filepath.Join(s.imageDir(), ref.Hash))
+			if err != nil {
+				log.Printf("Skipping missing history image %s: %v", ref.Hash, err)
+				continue
+			}
+			msg.Images = append(msg.Images, Image{Data: imgData, MIMEType: ref.MIMEType})
+		}
+		history = append(history, msg)
+	}
+	return history, nil
+}
+
+// Save implements HistoryStore. The history file is replaced atomically and image
+// files no longer referenced by any history are removed.
+func (s *FileHistoryStore) Save(name string, history []Message) error {
+	if err := os.MkdirAll(s.imageDir(), 0o755); err != nil {
+		return fmt.Errorf("error creating history directory: %w", err)
+	}
+
+	stored := make([]storedMessage, 0, len(history))
+	for _, msg := range history {
+		sm := storedMessage{Role: msg.Role, Content: msg.Content, Summary: msg.Summary, Time: msg.Time, Sources: msg.Sources, Locations: msg.Locations}
+		for _, img := range msg.Images {
+			hash, err := s.writeImage(img)
+			if err != nil {
+				return err
+			}
+			sm.Images = append(sm.Images, storedImage{Hash: hash, MIMEType: img.MIMEType})
+		}
+		stored = append(stored, sm)
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("error encoding history: %w", err)
+	}
+	if err := writeFileAtomic(s.historyPath(name), data); err != nil {
+		return fmt.Errorf("error writing history file: %w", err)
+	}
+
+	s.pruneImages()
+	return nil
+}
+
+// LoadPromptArm implements HistoryStore.
+func (s *FileHistoryStore) LoadPromptArm(name string) (*PromptArm, error) {
+	data, err := os.ReadFile(s.promptArmPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading prompt arm file: %w", err)
+	}
+	var arm PromptArm
+	if err := json.Unmarshal(data, &arm); err != nil {
+		return nil, fmt.Errorf("error parsing prompt arm file: %w", err)
+	}
+	return &arm, nil
+}
+
+// SavePromptArm implements HistoryStore.
+func (s *FileHistoryStore) SavePromptArm(name string, arm PromptArm) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return fmt.Errorf("error creating history directory: %w", err)
+	}
+	data, err := json.Marshal(arm)
+	if err != nil {
+		return fmt.Errorf("error encoding prompt arm: %w", err)
+	}
+	if err := writeFileAtomic(s.promptArmPath(name), data); err != nil {
+		return fmt.Errorf("error writing prompt arm file: %w", err)
+	}
+	return nil
+}
+
+// writeImage stores the image under its content hash unless it already exists.
+func (s *FileHistoryStore) writeImage(img Image) (string, error) {
+	sum := sha256.Sum256(img.Data)
+	hash := hex.EncodeToString(sum[:])
+	path := filepath.Join(s.imageDir(), hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	if err := writeFileAtomic(path, img.Data); err != nil {
+		return "", fmt.Errorf("error writing history image: %w", err)
+	}
+	return hash, nil
+}
+
+// pruneImages removes image files not referenced by any history file in Dir.
+func (s *FileHistoryStore) pruneImages() {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return
+	}
+	referenced := make(map[string]bool)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return // Never delete images while a history cannot be read
+		}
+		var stored []storedMessage
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return
+		}
+		for _, sm := range stored {
+			for _, ref := range sm.Images {
+				referenced[ref.Hash] = true
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(s.imageDir())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !referenced[entry.Name()] {
+			if err := os.Remove(filepath.Join(s.imageDir(), entry.Name())); err != nil {
+				log.Printf("Error removing unreferenced history image: %v", err)
+			}
+		}
+	}
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// historyTargets maps the store names to the clients whose history is persisted.
+// Ensemble members keep separate conversations and are stored individually.
+func historyTargets(aiClient AIClient, name string) map[string]AIClient {
+	if ensemble, ok := aiClient.(*EnsembleClient); ok {
+		targets := make(map[string]AIClient)
+		for _, member := range ensemble.Members {
+			targets[member.Name] = member.Client
+		}
+		return targets
+	}
+	return map[string]AIClient{strings.ToLower(name): aiClient}
+}
+
+// restoreHistory loads the saved histories into the clients.
+func restoreHistory(store HistoryStore, aiClient AIClient, name string, maxAge time.Duration) {
+	if store == nil {
+		return
+	}
+	for target, client := range historyTargets(aiClient, name) {
+		history, err := store.Load(target, maxAge)
+		if err != nil {
+			log.Printf("Error restoring history for %s: %v", target, err)
+			continue
+		}
+		for _, msg := range history {
+			client.AddMessageToHistory(msg)
+		}
+		if len(history) > 0 {
+			log.Printf("Restored %d history message(s) for %s", len(history), target)
+		}
+	}
+}
+
+// saveHistory persists the current histories of the clients.
+func saveHistory(store HistoryStore, aiClient AIClient, name string) {
+	if store == nil {
+		return
+	}
+	for target, client := range historyTargets(aiClient, name) {
+		if err := store.Save(target, client.GetMessageHistory()); err != nil {
+			log.Printf("Error saving history for %s: %v", target, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileHistoryStoreRoundTrip(t *testing.T) {
+	store := &FileHistoryStore{Dir: t.TempDir()}
+	now := time.Now().Round(time.Second)
+	history := []Message{
+		{Role: "user", Content: "Підсумок", Summary: true, Time: now.Add(-48 * time.Hour)},
+		{Role: "assistant", Content: "{}", Time: now.Add(-48 * time.Hour)},
+		{
+			Role:      "user",
+			Content:   "Шахеди над Затокою",
+			Time:      now,
+			Images:    []Image{{Data: []byte("jpeg"), MIMEType: "image/jpeg"}},
+			Sources:   []MessageSource{{Channel: "@first", MessageID: 1}, {Channel: "@second", MessageID: 7}},
+			Locations: []string{"Затока"},
+			Shingles:  []uint64{1, 2, 3},
+		},
+	}
+	if err := store.Save("claude", history); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := store.Load("claude", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 2 {
+		t.Fatalf("restored %d messages, want the summary and the recent one", len(restored))
+	}
+	if !restored[0].Summary {
+		t.Fatal("an old summary must be kept")
+	}
+	got, want := restored[1], history[2]
+	want.Shingles = nil
+	if !got.Time.Equal(want.Time) {
+		t.Fatalf("time = %v, want %v", got.Time, want.Time)
+	}
+	got.Time = want.Time
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored %+v, want %+v", got, want)
+	}
+}
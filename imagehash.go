@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// imageHash is a pair of 64-bit perceptual hashes. Reposts of a photo differ in
+// compression and size but keep nearly the same hashes.
+type imageHash struct {
+	// DHash compares neighbouring pixels of a 9x8 thumbnail (gradient hash)
+	DHash uint64
+	// AHash compares the pixels of an 8x8 thumbnail with their mean (average hash)
+	AHash uint64
+}
+
+// computeImageHash returns the perceptual hashes of a decoded image.
+func computeImageHash(img image.Image) imageHash {
+	var hash imageHash
+
+	gray := grayscaleThumbnail(img, 9, 8)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash.DHash <<= 1
+			if gray[y*9+x] < gray[y*9+x+1] {
+				hash.DHash |= 1
+			}
+		}
+	}
+
+	gray = grayscaleThumbnail(img, 8, 8)
+	mean := 0
+	for _, v := range gray {
+		mean += v
+	}
+	mean /= len(gray)
+	for _, v := range gray {
+		hash.AHash <<= 1
+		if v > mean {
+			hash.AHash |= 1
+		}
+	}
+	return hash
+}
+
+// grayscaleThumbnail shrinks the image to width x height luma values.
+func grayscaleThumbnail(img image.Image, width, height int) []int {
+	thumb := downscale(img, width, height).(*image.RGBA)
+	gray := make([]int, width*height)
+	for i := range gray {
+		p := thumb.Pix[i*4 : i*4+3]
+		gray[i] = (299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])) / 1000
+	}
+	return gray
+}
+
+// distance is the larger Hamming distance of the two hashes, so both must agree
+// before images are treated as the same.
+func (h imageHash) distance(other imageHash) int {
+	return max(bits.OnesCount64(h.DHash^other.DHash), bits.OnesCount64(h.AHash^other.AHash))
+}
+
+func (h imageHash) String() string {
+	return fmt.Sprintf("%016x/%016x", h.DHash, h.AHash)
+}
+
+// imageDedupEntry is an image seen recently.
+type imageDedupEntry struct {
+	hash    imageHash
+	channel string
+	seen    time.Time
+}
+
+// ImageDedupCache remembers the hashes of recent images so reposts of the same
+// photo across channels are sent to the AI only once.
+type ImageDedupCache struct {
+	// Window is how long an image is remembered, 0 disables deduplication
+	Window time.Duration
+	// MaxDistance is the largest Hamming distance still treated as the same image
+	MaxDistance int
+
+	mu      sync.Mutex
+	entries []imageDedupEntry
+}
+
+func newImageDedupCache(policy ImagePolicy) *ImageDedupCache {
+	return &ImageDedupCache{Window: policy.DedupWindow, MaxDistance: policy.DedupDistance}
+}
+
+// Check returns the channel that first posted a matching image within the window.
+// Unseen images are remembered and reported as not duplicate. A nil cache or a
+// zero window never reports duplicates.
+func (c *ImageDedupCache) Check(hash imageHash, channel string) (string, bool) {
+	if c == nil || c.Window <= 0 {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	kept := c.entries[:0]
+	for _, entry := range c.entries {
+		if now.Sub(entry.seen) <= c.Window {
+			kept = append(kept, entry)
+		}
+	}
+	c.entries = kept
+
+	for _, entry := range c.entries {
+		if distance := hash.distance(entry.hash); distance <= c.MaxDistance {
+			log.Printf("Image %s from %s matches image from %s (distance %d)", hash, channel, entry.channel, distance)
+			return entry.channel, true
+		}
+	}
+	c.entries = append(c.entries, imageDedupEntry{hash: hash, channel: channel, seen: now})
+	return "", false
+}
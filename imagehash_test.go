@@ -0,0 +1,72 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+// testImage draws a diagonal gradient, optionally inverted, with a dark square
+// in the top left corner so the hashes are not symmetric.
+func testImage(width, height int, invert bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(255 * (x + y) / (width + height))
+			if x < width/4 && y < height/4 {
+				v = 20
+			}
+			if invert {
+				v = 255 - v
+			}
+			img.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+func TestImageHashDistance(t *testing.T) {
+	original := computeImageHash(testImage(640, 480, false))
+	tests := []struct {
+		name string
+		img  image.Image
+		min  int
+		max  int
+	}{
+		{"same image", testImage(640, 480, false), 0, 0},
+		{"scaled copy", testImage(320, 240, false), 0, 6},
+		{"inverted", testImage(640, 480, true), 32, 64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d := original.distance(computeImageHash(tt.img)); d < tt.min || d > tt.max {
+				t.Fatalf("distance = %d, want between %d and %d", d, tt.min, tt.max)
+			}
+		})
+	}
+
+	if s := (imageHash{DHash: 0xff, AHash: 1}).String(); s != "00000000000000ff/0000000000000001" {
+		t.Fatalf("String = %s", s)
+	}
+}
+
+func TestImageDedupCache(t *testing.T) {
+	cache := &ImageDedupCache{Window: time.Minute, MaxDistance: 6}
+	hash := computeImageHash(testImage(640, 480, false))
+
+	if _, dup := cache.Check(hash, "@first"); dup {
+		t.Fatal("first image reported as duplicate")
+	}
+	if original, dup := cache.Check(computeImageHash(testImage(320, 240, false)), "@second"); !dup || original != "@first" {
+		t.Fatalf("Check = %q, %v, want @first, true", original, dup)
+	}
+	if _, dup := cache.Check(computeImageHash(testImage(640, 480, true)), "@second"); dup {
+		t.Fatal("a different image reported as duplicate")
+	}
+
+	disabled := &ImageDedupCache{MaxDistance: 64}
+	if _, dup := disabled.Check(hash, "@first"); dup {
+		t.Fatal("a zero window must not report duplicates")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"log"
+	"time"
+)
+
+// ImagePolicy controls how downloaded images are prepared before they reach the AI.
+type ImagePolicy struct {
+	// MaxDimension is the longest edge in pixels after downscaling, 0 keeps the size
+	MaxDimension int
+	// JPEGQuality is the quality used when re-encoding (1-100)
+	JPEGQuality int
+	// MaxPerBatch caps the images sent in one batch, the newest are kept; 0 disables the cap
+	MaxPerBatch int
+	// DedupWindow is how long images are remembered for cross-channel deduplication, 0 disables it
+	DedupWindow time.Duration
+	// DedupDistance is the largest perceptual hash distance treated as the same image
+	DedupDistance int
+}
+
+func loadImagePolicy() ImagePolicy {
+	policy := ImagePolicy{
+		MaxDimension:  envInt("AI_IMAGE_MAX_DIMENSION", 1024),
+		JPEGQuality:   envInt("AI_IMAGE_JPEG_QUALITY", 80),
+		MaxPerBatch:   envInt("AI_MAX_IMAGES_PER_BATCH", 4),
+		DedupWindow:   envDuration("AI_IMAGE_DEDUP_WINDOW", 15*time.Minute),
+		DedupDistance: envInt("AI_IMAGE_DEDUP_DISTANCE", 6),
+	}
+	if policy.JPEGQuality < 1 || policy.JPEGQuality > 100 {
+		log.Printf("Invalid AI_IMAGE_JPEG_QUALITY %d, using %d", policy.JPEGQuality, jpeg.DefaultQuality)
+		policy.JPEGQuality = jpeg.DefaultQuality
+	}
+	return policy
+}
+
+// preprocessImage decodes the image to make sure it is valid, downscales it to
+// MaxDimension and re-encodes it as JPEG. Re-encoding drops EXIF and any other
+// metadata. Images that cannot be decoded are rejected. The perceptual hash is
+// computed on the way.
+func preprocessImage(img Image, policy ImagePolicy) (Image, error) {
+	src, format, err := image.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		return Image{}, fmt.Errorf("invalid or unsupported image (%s, %d bytes): %w", img.MIMEType, len(img.Data), err)
+	}
+
+	bounds := src.Bounds()
+	dst := src
+	if width, height, ok := fitDimensions(bounds.Dx(), bounds.Dy(), policy.MaxDimension); ok {
+		dst = downscale(src, width, height)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: policy.JPEGQuality}); err != nil {
+		return Image{}, fmt.Errorf("error encoding image: %w", err)
+	}
+
+	log.Printf("Preprocessed image: %s %dx%d %d bytes -> jpeg %dx%d %d bytes",
+		format, bounds.Dx(), bounds.Dy(), len(img.Data), dst.Bounds().Dx(), dst.Bounds().Dy(), buf.Len())
+	return Image{Data: buf.Bytes(), MIMEType: "image/jpeg", Hash: computeImageHash(dst)}, nil
+}
+
+// fitDimensions scales width and height so the longest edge is maxDimension,
+// reporting false when the image already fits.
+func fitDimensions(width, height, maxDimension int) (int, int, bool) {
+	if maxDimension <= 0 || (width <= maxDimension && height <= maxDimension) {
+		return width, height, false
+	}
+	if width >= height {
+		return maxDimension, max(1, height*maxDimension/width), true
+	}
+	return max(1, width*maxDimension/height), maxDimension, true
+}
+
+// downscale resizes src with an area average, each destination pixel being the
+// mean of the source pixels it covers. It only shrinks, which is all we need.
+func downscale(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcH/height, max((y+1)*srcH/height, y*srcH/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcW/width, max((x+1)*srcW/width, x*srcW/width+1)
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// capBatchImages keeps the newest images of a merged batch message within the limit.
+func capBatchImages(message Message, limit int) Message {
+	if limit <= 0 || len(message.Images) <= limit {
+		return message
+	}
+	dropped := len(message.Images) - limit
+	log.Printf("Batch has %d images, dropping the %d oldest", len(message.Images), dropped)
+	message.Images = append([]Image(nil), message.Images[dropped:]...)
+	message.Content = fmt.Sprintf("%s\n[%d older image(s) from this batch omitted]", message.Content, dropped)
+	return message
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestFitDimensions(t *testing.T) {
+	tests := []struct {
+		width, height, max int
+		wantW, wantH       int
+		wantScaled         bool
+	}{
+		{800, 600, 1568, 800, 600, false},
+		{1568, 1568, 1568, 1568, 1568, false},
+		{3136, 2000, 1568, 1568, 1000, true},
+		{1000, 4000, 1568, 392, 1568, true},
+		{10000, 1, 1568, 1568, 1, true},
+		{4000, 3000, 0, 4000, 3000, false},
+	}
+	for _, tt := range tests {
+		w, h, scaled := fitDimensions(tt.width, tt.height, tt.max)
+		if w != tt.wantW || h != tt.wantH || scaled != tt.wantScaled {
+			t.Errorf("fitDimensions(%d, %d, %d) = %d, %d, %v, want %d, %d, %v",
+				tt.width, tt.height, tt.max, w, h, scaled, tt.wantW, tt.wantH, tt.wantScaled)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+)
+
+const defaultLiveStatusFile = "config/live_status.json"
+
+// LiveStatus is the pinned status message of one channel.
+type LiveStatus struct {
+	MessageID int `json:"messageId"`
+	// Danger is the verdict shown, a new post is sent only when it turns true
+	Danger  bool      `json:"danger"`
+	Updated time.Time `json:"updated"`
+}
+
+// LiveStatusStore keeps the pinned message of every live channel in a JSON
+// file, so restarts keep editing the same message.
+type LiveStatusStore struct {
+	Path string
+
+	mu sync.Mutex
+	// channelLocks serialize the updates of each channel, see lock
+	locksMu      sync.Mutex
+	channelLocks map[string]*sync.Mutex
+}
+
+// loadLiveStatusStore returns the store at LIVE_STATUS_FILE.
+func loadLiveStatusStore() *LiveStatusStore {
+	return &LiveStatusStore{Path: getEnv("LIVE_STATUS_FILE", defaultLiveStatusFile)}
+}
+
+func (s *LiveStatusStore) read() (map[string]LiveStatus, error) {
+	statuses := make(map[string]LiveStatus)
+	data, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return statuses, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &statuses); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", s.Path, err)
+	}
+	return statuses, nil
+}
+
+// lock serializes the live updates of a channel: publishes can run concurrently
+// once reviewed posts are approved, and two updates reading the same status would
+// each pin a new message. It returns the unlock function.
+func (s *LiveStatusStore) lock(channel string) func() {
+	s.locksMu.Lock()
+	if s.channelLocks == nil {
+		s.channelLocks = make(map[string]*sync.Mutex)
+	}
+	channelLock, ok := s.channelLocks[channel]
+	if !ok {
+		channelLock = &sync.Mutex{}
+		s.channelLocks[channel] = channelLock
+	}
+	s.locksMu.Unlock()
+
+	channelLock.Lock()
+	return channelLock.Unlock
+}
+
+// Get returns the live status of the channel, zero when none was posted yet.
+func (s *LiveStatusStore) Get(channel string) LiveStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses, err := s.read()
+	if err != nil {
+		log.Printf("Error reading live status: %v", err)
+		return LiveStatus{}
+	}
+	return statuses[channel]
+}
+
+// Set stores the live status of the channel.
+func (s *LiveStatusStore) Set(channel string, status LiveStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses, err := s.read()
+	if err != nil {
+		// A corrupt file would otherwise block every update
+		log.Printf("Error reading live status, starting over: %v", err)
+		statuses = make(map[string]LiveStatus)
+	}
+	statuses[channel] = status
+	data, err := json.MarshalIndent(statuses, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.Path, data)
+}
+
+// formatLiveStatus renders the pinned message: the current post, the alert
+// state and the update time.
+func formatLiveStatus(post Post) string {
+	var b strings.Builder
+	b.WriteString("📍 Поточна обстановка\n\n")
+	b.WriteString(post.Text)
+	b.WriteString("\n\n")
+	if post.Alert {
+		b.WriteString("🔴 Повітряна тривога")
+		if post.AlertDuration != "" {
+			b.WriteString(" триває " + post.AlertDuration)
+		}
+	} else {
+		b.WriteString("🟢 Тривоги немає")
+	}
+	fmt.Fprintf(&b, "\n🕒 Оновлено о %s", post.Time.In(promptLocation).Format("15:04"))
+	return b.String()
+}
+
+// publishLive edits the pinned status message of the channel in place. Only an
+// escalation, danger turning true, is also sent as a new post so subscribers
+// get notified.
+func (s *TelegramSink) publishLive(ctx context.Context, post Post) error {
+	defer s.Live.lock(s.Channel)()
+
+	status := s.Live.Get(s.Channel)
+	if post.Danger && !status.Danger {
+		if err := sendResponse(ctx, s.api, s.Channel, s.Map, post.Response, s.render(post)); err != nil {
+			return err
+		}
+		// Saved right away, so a failing edit below does not repeat the loud escalation post
+		status.Danger = true
+		if err := s.Live.Set(s.Channel, status); err != nil {
+			log.Printf("Error saving live status escalation in %s: %v", s.Channel, err)
+		}
+	}
+
+	channel, err := resolveChannel(ctx, s.api, s.Channel)
+	if err != nil {
+		return err
+	}
+	// The pinned message wraps the post text, so template entities are not kept
+	text := formatLiveStatus(Post{Time: post.Time, Text: s.render(post).Text, Alert: post.Alert, AlertDuration: post.AlertDuration})
+
+	if status.MessageID != 0 {
+		_, err = s.api.MessagesEditMessage(ctx, &tg.MessagesEditMessageRequest{
+			Peer:    channel.AsInputPeer(),
+			ID:      status.MessageID,
+			Message: text,
+		})
+		switch {
+		case err == nil, tgerr.Is(err, "MESSAGE_NOT_MODIFIED"):
+			return s.Live.Set(s.Channel, LiveStatus{MessageID: status.MessageID, Danger: post.Danger, Updated: post.Time})
+		case tgerr.Is(err, "MESSAGE_ID_INVALID", "MESSAGE_EDIT_TIME_EXPIRED", "MESSAGE_AUTHOR_REQUIRED"):
+			log.Printf("Live status message %d in %s can no longer be edited, posting a new one: %v", status.MessageID, s.Channel, err)
+		default:
+			return fmt.Errorf("failed to edit live status: %v", err)
+		}
+	}
+
+	// The first live update, or the old message is gone: post and pin a new one
+	updates, err := s.api.MessagesSendMessage(ctx, &tg.MessagesSendMessageRequest{
+		Peer:     channel.AsInputPeer(),
+		Message:  text,
+		RandomID: rand.Int63(),
+		Silent:   true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send live status: %v", err)
+	}
+	messageID, ok := sentMessageID(updates)
+	if !ok {
+		return fmt.Errorf("live status sent but its message ID is missing")
+	}
+	if _, err := s.api.MessagesUpdatePinnedMessage(ctx, &tg.MessagesUpdatePinnedMessageRequest{
+		Peer:   channel.AsInputPeer(),
+		ID:     messageID,
+		Silent: true,
+	}); err != nil {
+		log.Printf("Error pinning live status in %s: %v", s.Channel, err)
+	}
+	log.Printf("Posted live status message %d in %s", messageID, s.Channel)
+	return s.Live.Set(s.Channel, LiveStatus{MessageID: messageID, Danger: post.Danger, Updated: post.Time})
+}
+
+// sentMessageID finds the ID of a message just sent in the updates returned by Telegram.
+func sentMessageID(updates tg.UpdatesClass) (int, bool) {
+	switch u := updates.(type) {
+	case *tg.UpdateShortSentMessage:
+		return u.ID, true
+	case *tg.Updates:
+		for _, update := range u.Updates {
+			switch update := update.(type) {
+			case *tg.UpdateMessageID:
+				return update.ID, true
+			case *tg.UpdateNewChannelMessage:
+				return update.Message.GetID(), true
+			case *tg.UpdateNewMessage:
+				return update.Message.GetID(), true
+			}
+		}
+	}
+	return 0, false
+}
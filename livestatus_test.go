@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLiveStatusStore(t *testing.T) {
+	store := &LiveStatusStore{Path: filepath.Join(t.TempDir(), "live_status.json")}
+	if status := store.Get("@odesa"); status.MessageID != 0 || status.Danger {
+		t.Fatalf("Get without a file = %+v, want zero", status)
+	}
+
+	want := LiveStatus{MessageID: 42, Danger: true, Updated: time.Now().Round(time.Second)}
+	if err := store.Set("@odesa", want); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("@other", LiveStatus{MessageID: 7}); err != nil {
+		t.Fatal(err)
+	}
+	got := store.Get("@odesa")
+	if got.MessageID != want.MessageID || got.Danger != want.Danger || !got.Updated.Equal(want.Updated) {
+		t.Fatalf("Get = %+v, want %+v", got, want)
+	}
+}
+
+// Concurrent updates of one channel must not interleave, or both create a message.
+func TestLiveStatusStoreLock(t *testing.T) {
+	store := &LiveStatusStore{Path: filepath.Join(t.TempDir(), "live_status.json")}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer store.lock("@odesa")()
+			if store.Get("@odesa").MessageID == 0 {
+				mu.Lock()
+				created++
+				mu.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				if err := store.Set("@odesa", LiveStatus{MessageID: 1}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Fatalf("%d updates created a live message, want 1", created)
+	}
+
+	// Other channels are not held up by a busy one
+	unlock := store.lock("@odesa")
+	defer unlock()
+	done := make(chan struct{})
+	go func() {
+		store.lock("@other")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lock of another channel blocked")
+	}
+}
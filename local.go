@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// LocalClient implements the AIClient interface for a self-hosted llama.cpp server
+// (OpenAI-compatible /v1/chat/completions). Output is constrained with a GBNF
+// grammar generated from the AIJSONResponse schema.
+type LocalClient struct {
+	APIKey         string
+	HTTPClient     *http.Client
+	Retry          RetryPolicy
+	History        HistoryPolicy
+	SystemMessage  string
+	MessageHistory []Message
+	// Endpoint is the chat completions URL of the local server
+	Endpoint string
+	// Model is passed through to the server; llama.cpp ignores it but other servers may not
+	Model         string
+	FallbackModel string
+	Usage         *UsageTracker
+	Prompt        *PromptState
+	// mu guards SystemMessage and MessageHistory; sendMu serializes SendMessage calls
+	mu     sync.Mutex
+	sendMu sync.Mutex
+}
+
+// Local server defaults
+const (
+	localAPIEndpoint = "http://localhost:8080/v1/chat/completions"
+	localModel       = "local"
+)
+
+// AddMessageToHistory adds a message to the client's history, maintaining max history size.
+func (c *LocalClient) AddMessageToHistory(message Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = appendHistory(c.MessageHistory, message, c.History)
+}
+
+// GetMessageHistory returns a copy of the current message history.
+func (c *LocalClient) GetMessageHistory() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return copyHistory(c.MessageHistory)
+}
+
+// SetSystemMessage replaces the system message used for subsequent requests.
+func (c *LocalClient) SetSystemMessage(systemMessage string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SystemMessage = systemMessage
+}
+
+// ForgetRepair removes a validation repair exchange from the history.
+func (c *LocalClient) ForgetRepair(request string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = withoutRepair(c.MessageHistory, request)
+}
+
+// SendMessage sends the current message history to the local server and returns the AI's response.
+func (c *LocalClient) SendMessage(ctx context.Context, message Message) (AIJSONResponse, error) {
+	// Requests on one client are serialized so the conversation stays in order
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	c.AddMessageToHistory(message)
+	history := prepareHistory(ctx, &c.mu, &c.MessageHistory, c.History, "local")
+	c.mu.Lock()
+	systemMessage := c.SystemMessage
+	c.mu.Unlock()
+
+	model, textOnly := c.Usage.SelectModel("local", c.Model, c.FallbackModel)
+	if textOnly {
+		history = withoutImages(history)
+	}
+
+	var apiMessages []map[string]interface{}
+
+	// System message
+	apiMessages = append(apiMessages, map[string]interface{}{
+		"role":    "system",
+		"content": c.Prompt.Render(systemMessage).String() + "\n" + schemaInstruction(),
+	})
+
+	// History messages
+	for _, msg := range history {
+		if len(msg.Images) > 0 {
+			var contentParts []map[string]interface{}
+
+			// Add text
+			if msg.Content != "" {
+				contentParts = append(contentParts, map[string]interface{}{
+					"type": "text",
+					"text": msg.Content,
+				})
+			}
+
+			// Add images (requires a multimodal projector on the server)
+			for _, img := range msg.Images {
+				contentParts = append(contentParts, map[string]interface{}{
+					"type": "image_url",
+					"image_url": map[string]string{
+						"url": fmt.Sprintf("data:%s;base64,%s", img.MIMEType, base64.StdEncoding.EncodeToString(img.Data)),
+					},
+				})
+			}
+
+			apiMessages = append(apiMessages, map[string]interface{}{
+				"role":    msg.Role,
+				"content": contentParts,
+			})
+		} else {
+			apiMessages = append(apiMessages, map[string]interface{}{
+				"role":    msg.Role,
+				"content": msg.Content,
+			})
+		}
+	}
+
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"model":    model,
+		"messages": apiMessages,
+		"grammar":  gbnfGrammar(aiResponseSchema()),
+	})
+	if err != nil {
+		return AIJSONResponse{}, fmt.Errorf("failed to marshal local request body: %w", err)
+	}
+
+	headers := map[string]string{}
+	if c.APIKey != "" {
+		headers["Authorization"] = fmt.Sprintf("Bearer %s", c.APIKey)
+	}
+
+	var aiResp AIJSONResponse
+	err = c.Retry.Do(ctx, "local", func(ctx context.Context) error {
+		body, err := postJSON(ctx, c.HTTPClient, "local", c.Endpoint, headers, reqBody)
+		if err != nil {
+			return err
+		}
+
+		var localResp struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+			Usage openAIUsage `json:"usage"`
+		}
+		if err := json.Unmarshal(body, &localResp); err != nil {
+			return malformed(fmt.Errorf("failed to unmarshal local response: %w body: %s", err, string(body)))
+		}
+		c.Usage.Record("local", model, localResp.Usage.tokenUsage(history, "local"))
+
+		if len(localResp.Choices) == 0 {
+			return malformed(fmt.Errorf("no choices in local response"))
+		}
+
+		aiResp, err = parseAIJSON(localResp.Choices[0].Message.Content)
+		if err != nil {
+			log.Printf("Failed to parse JSON from local response: %v", err)
+			return malformed(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return AIJSONResponse{}, err
+	}
+
+	c.AddMessageToHistory(Message{Role: "assistant", Content: fmt.Sprintf("%s Danger: %v StatusChanged: %v", aiResp.Text, aiResp.Danger, aiResp.StatusChanged)})
+
+	return aiResp, nil
+}
@@ -11,7 +11,9 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,6 +30,8 @@ import (
 const (
 	maxMessageHistory = 20
 	systemMessageFile = "config/system_message.txt"
+	// systemMessageDebounce collects the events of one save into a single reload
+	systemMessageDebounce = 500 * time.Millisecond
 )
 
 var sendToChannel = getEnv("SEND_TO_CHANNEL", "odesair")
@@ -48,7 +52,7 @@ func loadConfig() Config {
 		aiBatchExtendDuration = 3 * time.Second
 	}
 
-	return Config{
+	config := Config{
 		APIID:       appID,
 		APIHash:     getEnv("APPHASH", ""),
 		PhoneNumber: getEnv("PHONE_NUMBER", ""),
@@ -67,7 +71,24 @@ func loadConfig() Config {
 		IgnoreAirAttack:       getEnv("IGNORE_AIR_ATTACK", "false") == "true",
 		AIBatchInterval:       aiBatchInterval,
 		AIBatchExtendDuration: aiBatchExtendDuration,
+		EnsembleProviders:     splitList(getEnv("ENSEMBLE_PROVIDERS", "")),
+		EnsemblePolicy:        getEnv("ENSEMBLE_POLICY", ensemblePolicyMajority),
+		EnsemblePrimary:       getEnv("ENSEMBLE_PRIMARY", ""),
+		EnsembleWeights:       parseWeights(getEnv("ENSEMBLE_WEIGHTS", "")),
+		EnsembleLogFile:       getEnv("ENSEMBLE_DISAGREEMENT_LOG", ""),
+		Validation:            loadValidationRules(),
+		Images:                loadImagePolicy(),
+		TextDedup:             loadTextDedupPolicy(),
+		Retry:                 loadRetryPolicy(),
+		History:               loadHistoryPolicy(),
+		HistoryStore:          loadHistoryStore(),
+		HistoryMaxAge:         envDuration("HISTORY_MAX_AGE", 30*time.Minute),
+		Usage:                 loadUsageTracker(),
+		Exchanges:             loadExchangeLog(),
+		PublishGuard:          newPublishGuard(loadPublishGuardPolicy()),
 	}
+	config.Prompt = newPromptState(config.Channels)
+	return config
 }
 
 type Config struct {
@@ -84,6 +105,28 @@ type Config struct {
 	IgnoreAirAttack       bool
 	AIBatchInterval       time.Duration
 	AIBatchExtendDuration time.Duration
+	EnsembleProviders     []string
+	EnsemblePolicy        string
+	EnsemblePrimary       string
+	EnsembleWeights       map[string]float64
+	EnsembleLogFile       string
+	Validation            ValidationRules
+	Images                ImagePolicy
+	Filter                *MessageFilter
+	Gazetteer             *Gazetteer
+	ThreatMap             *ThreatMap
+	Publishers            *PublishGroup
+	Approval              *Approver
+	PublishGuard          *PublishGuard
+	TextDedup             TextDedupPolicy
+	Retry                 RetryPolicy
+	History               HistoryPolicy
+	HistoryStore          HistoryStore
+	HistoryMaxAge         time.Duration
+	Usage                 *UsageTracker
+	Prompt                *PromptState
+	Prompts               *PromptLibrary
+	Exchanges             *ExchangeLog
 }
 
 type ChannelInfo struct {
@@ -97,50 +140,108 @@ type AIClient interface {
 	GetMessageHistory() []Message
 }
 
+// AIJSONResponse is the structured answer every provider must produce.
+// The desc tags are sent to providers as part of the generated response schema.
 type AIJSONResponse struct {
-	Text          string `json:"text" yaml:"text"`
-	Principle     string `json:"principle" yaml:"principle"`
-	Danger        bool   `json:"danger" yaml:"danger"`
-	StatusChanged bool   `json:"statusChanged" yaml:"statusChanged"`
+	Text          string `json:"text" yaml:"text" desc:"Short post for the channel describing the current situation"`
+	Principle     string `json:"principle" yaml:"principle" desc:"Reasoning behind the verdict, not published"`
+	Danger        bool   `json:"danger" yaml:"danger" desc:"True while there is an active threat to Odesa"`
+	StatusChanged bool   `json:"statusChanged" yaml:"statusChanged" desc:"True when the situation changed since the last published post"`
+	// The structured fields below are optional for the model and meant for machine consumers
+	Threats    []ThreatReport `json:"threats" yaml:"threats" desc:"Threats currently reported, empty when there is none"`
+	Confidence *float64       `json:"confidence" yaml:"confidence" desc:"Confidence in the danger verdict from 0 to 1, null when unsure how to rate"`
+	Sources    []string       `json:"sources" yaml:"sources" desc:"Channels whose messages the verdict is based on"`
 }
 
 type Image struct {
 	Data     []byte
 	MIMEType string
+	// Hash is the perceptual hash, set by preprocessImage
+	Hash imageHash
 }
 
 type Message struct {
 	Role    string  `json:"role"`
 	Content string  `json:"content"`
 	Images  []Image `json:"-"`
+	// Summary marks the rolling situation summary kept at the head of the history
+	Summary bool `json:"summary,omitempty"`
+	// Time is when the message entered the history
+	Time time.Time `json:"time"`
+	// Sources lists the channel posts carrying this text, more than one for collapsed reposts
+	Sources []MessageSource `json:"sources,omitempty"`
+	// Shingles is the text fingerprint used to detect reposts, nil when not deduplicated
+	Shingles []uint64 `json:"-"`
+	// Locations names the gazetteer places the text mentions
+	Locations []string `json:"locations,omitempty"`
 }
 
 type ClaudeClient struct {
 	APIKey         string
 	HTTPClient     *http.Client
+	Retry          RetryPolicy
+	History        HistoryPolicy
 	SystemMessage  string
 	MessageHistory []Message
+	Model          string
+	FallbackModel  string
+	Usage          *UsageTracker
+	Prompt         *PromptState
+	// MaxTokens limits the answer, excluding the thinking budget
+	MaxTokens int
+	// ThinkingBudget enables extended thinking with this many tokens, 0 disables it
+	ThinkingBudget int
+	// mu guards SystemMessage and MessageHistory; sendMu serializes SendMessage calls
+	mu     sync.Mutex
+	sendMu sync.Mutex
 }
 
 type ChatGPTClient struct {
 	APIKey         string
 	HTTPClient     *http.Client
+	Retry          RetryPolicy
+	History        HistoryPolicy
 	SystemMessage  string
 	MessageHistory []Message
+	Model          string
+	FallbackModel  string
+	Usage          *UsageTracker
+	Prompt         *PromptState
+	// mu guards SystemMessage and MessageHistory; sendMu serializes SendMessage calls
+	mu     sync.Mutex
+	sendMu sync.Mutex
 }
 
 type OpenRouterClient struct {
 	APIKey         string
 	HTTPClient     *http.Client
+	Retry          RetryPolicy
+	History        HistoryPolicy
 	SystemMessage  string
 	MessageHistory []Message
+	Model          string
+	FallbackModel  string
+	Usage          *UsageTracker
+	Prompt         *PromptState
+	// mu guards SystemMessage and MessageHistory; sendMu serializes SendMessage calls
+	mu     sync.Mutex
+	sendMu sync.Mutex
 }
 
 type GeminiClient struct {
 	APIKey         string
 	HTTPClient     *http.Client
+	Retry          RetryPolicy
+	History        HistoryPolicy
 	SystemMessage  string
 	MessageHistory []Message
+	Model          string
+	FallbackModel  string
+	Usage          *UsageTracker
+	Prompt         *PromptState
+	// mu guards SystemMessage and MessageHistory; sendMu serializes SendMessage calls
+	mu     sync.Mutex
+	sendMu sync.Mutex
 }
 
 // GLMClient struct is defined in glm.go
@@ -152,6 +253,7 @@ func main() {
 	log.Printf("  AI Choice: %s", config.AIChoice)
 	log.Printf("  Ignore Air Attack: %v", config.IgnoreAirAttack)
 	log.Printf("  Enable Telegram Send: %v", config.EnableTelegramSend)
+	log.Printf("  Publish Guard: %v", config.PublishGuard.policy)
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
@@ -160,13 +262,39 @@ func main() {
 		SessionStorage: &session.FileStorage{Path: config.SessionFilePath},
 	})
 
+	prompts, err := loadPromptLibrary()
+	if err != nil {
+		log.Fatalf("Failed to load prompt library: %v", err)
+	}
+	config.Prompts = prompts
 	aiClient, err := initAIClient(config)
 	if err != nil {
 		log.Fatalf("Failed to initialize AI client: %v", err)
 	}
-
-	// Start watching the system message file
-	go watchSystemMessageFile(aiClient)
+	if config.Filter, err = loadMessageFilter(); err != nil {
+		log.Fatalf("Failed to load message filter: %v", err)
+	}
+	if config.Gazetteer, err = loadGazetteer(); err != nil {
+		log.Fatalf("Failed to load gazetteer: %v", err)
+	}
+	config.Validation.Gazetteer = config.Gazetteer
+	if config.ThreatMap, err = loadThreatMap(config.Gazetteer); err != nil {
+		log.Fatalf("Failed to load threat map: %v", err)
+	}
+	if config.Publishers, err = loadPublishers(config.ThreatMap, loadOutputTemplates()); err != nil {
+		log.Fatalf("Failed to load output sinks: %v", err)
+	}
+	config.Approval = newApprover(loadApprovalPolicy())
+	config.Approval.Start(ctx)
+	config.Usage.Start(ctx)
+	startMetricsServer()
+	restoreHistory(config.HistoryStore, aiClient, config.AIChoice, config.HistoryMaxAge)
+	restorePromptArms(config.HistoryStore, config.Prompts, aiClient, config.AIChoice)
+
+	// Start watching the system message file; library prompts are re-read on every exchange instead
+	if config.Prompts == nil {
+		go watchSystemMessageFile(aiClient, config.Prompt)
+	}
 
 	if err := client.Run(ctx, func(ctx context.Context) error {
 		if err := authenticateTelegram(ctx, client, config); err != nil {
@@ -174,6 +302,7 @@ func main() {
 		}
 
 		api := client.API()
+		config.Publishers.BindTelegram(api)
 		return monitorChannels(ctx, api, config, aiClient)
 	}); err != nil {
 		log.Fatal(err)
@@ -188,137 +317,284 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// splitList splits a comma separated env value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseWeights parses "name=weight,name=weight" into a map. Invalid entries are logged and skipped.
+func parseWeights(value string) map[string]float64 {
+	weights := make(map[string]float64)
+	for _, item := range splitList(value) {
+		name, raw, ok := strings.Cut(item, "=")
+		if !ok {
+			log.Printf("Invalid weight entry '%s', expected name=weight", item)
+			continue
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			log.Printf("Invalid weight for '%s': %v", name, err)
+			continue
+		}
+		weights[strings.ToLower(strings.TrimSpace(name))] = weight
+	}
+	return weights
+}
+
+// readSystemMessage reads and validates the system message file.
 func readSystemMessage() (string, error) {
 	content, err := ioutil.ReadFile(systemMessageFile)
 	if err != nil {
 		return "", fmt.Errorf("error reading system message file: %v", err)
 	}
+	if err := validateSystemMessage(content); err != nil {
+		return "", fmt.Errorf("invalid system message file: %v", err)
+	}
 
 	fmt.Println("System message: ", string(content))
 	return string(content), nil
 }
 
-func watchSystemMessageFile(aiClient AIClient) {
+// watchSystemMessageFile reloads the system message when the file changes. The
+// parent directory is watched rather than the file, because editors and ConfigMap
+// updates replace the file by rename or symlink swap, which would end a watch on
+// the file itself. Bursts of events are debounced into one reload.
+func watchSystemMessageFile(aiClient AIClient, prompt *PromptState) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatalf("Failed to create file watcher: %v", err)
 	}
 	defer watcher.Close()
 
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					log.Println("System message file modified. Updating...")
-					newMessage, err := readSystemMessage()
-					if err != nil {
-						log.Printf("Error reading system message: %v", err)
-						continue
-					}
-					updateAIClientSystemMessage(aiClient, newMessage)
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				log.Println("Error watching system message file:", err)
+	dir, name := filepath.Split(systemMessageFile)
+	if dir == "" {
+		dir = "."
+	}
+	if err := watcher.Add(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	var debounce *time.Timer
+	var debounceChan <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// ConfigMaps swap the ..data symlink instead of touching the file
+			base := filepath.Base(event.Name)
+			if base != name && !strings.HasPrefix(base, "..data") {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			if debounce != nil {
+				debounce.Stop()
 			}
+			debounce = time.NewTimer(systemMessageDebounce)
+			debounceChan = debounce.C
+		case <-debounceChan:
+			debounce, debounceChan = nil, nil
+			reloadSystemMessage(aiClient, prompt)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("Error watching system message file:", err)
 		}
-	}()
+	}
+}
 
-	err = watcher.Add(systemMessageFile)
+// reloadSystemMessage applies the system message file if it changed and is valid.
+// A missing or invalid file keeps the current prompt; the file being recreated
+// triggers another reload.
+func reloadSystemMessage(aiClient AIClient, prompt *PromptState) {
+	newMessage, err := readSystemMessage()
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Keeping system message version %s: %v", prompt.Version(), err)
+		return
 	}
-	<-done
+	version := promptVersion(newMessage)
+	if version == prompt.Version() {
+		return
+	}
+	log.Printf("System message file modified, updating to version %s (was %s)", version, prompt.Version())
+	updateAIClientSystemMessage(aiClient, newMessage)
+	prompt.SetVersion(version)
+}
+
+// systemMessageSetter is implemented by clients whose system message can be replaced at runtime.
+type systemMessageSetter interface {
+	SetSystemMessage(systemMessage string)
 }
 
 func updateAIClientSystemMessage(aiClient AIClient, newMessage string) {
 	switch c := aiClient.(type) {
-	case *ClaudeClient:
-		c.SystemMessage = newMessage
-	case *ChatGPTClient:
-		c.SystemMessage = newMessage
-	case *DeepseekClient:
-		c.SystemMessage = newMessage
-	case *OpenRouterClient:
-		c.SystemMessage = newMessage
-	case *GeminiClient:
-		c.SystemMessage = newMessage
-	case *GLMClient:
-		c.SystemMessage = newMessage
+	case *EnsembleClient:
+		for _, member := range c.Members {
+			updateAIClientSystemMessage(member.Client, newMessage)
+		}
+		return
+	case systemMessageSetter:
+		c.SetSystemMessage(newMessage)
 	default:
 		log.Println("Unknown AI client type")
+		return
 	}
 	log.Println("AI client system message updated successfully")
 }
 
 func initAIClient(config Config) (AIClient, error) {
-	systemMessage, err := readSystemMessage()
-	if err != nil {
-		return nil, fmt.Errorf("failed to read system message: %v", err)
+	// With a prompt library the system message is set before every exchange
+	systemMessage := ""
+	var err error
+	if config.Prompts == nil {
+		systemMessage, err = readSystemMessage()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read system message: %v", err)
+		}
+		config.Prompt.SetVersion(promptVersion(systemMessage))
+		log.Printf("System message version %s", config.Prompt.Version())
 	}
 
 	log.Printf("Initializing AI client with choice: %s", config.AIChoice)
 
-	switch strings.ToLower(config.AIChoice) {
+	config.History.Summarizer, err = newHistorySummarizer(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize history summarizer: %v", err)
+	}
+
+	if strings.ToLower(config.AIChoice) == "ensemble" {
+		return newEnsembleClient(config, systemMessage)
+	}
+	return newAIClient(config, config.AIChoice, systemMessage)
+}
+
+// providerAPIKey returns the API key for a provider, preferring <PROVIDER>_API_KEY
+// over the shared API_KEY so that several providers can run side by side.
+func providerAPIKey(config Config, choice string) string {
+	return getEnv(strings.ToUpper(choice)+"_API_KEY", config.AIAPIKey)
+}
+
+func newAIClient(config Config, choice, systemMessage string) (AIClient, error) {
+	apiKey := providerAPIKey(config, choice)
+	httpClient := newAIHTTPClient(config.Retry)
+	fallbackModel := getEnv(strings.ToUpper(choice)+"_FALLBACK_MODEL", "")
+
+	switch strings.ToLower(choice) {
 	case "claude":
 		log.Println("Initializing Claude client")
 		return &ClaudeClient{
-			APIKey:         config.AIAPIKey,
-			HTTPClient:     &http.Client{},
+			APIKey:         apiKey,
+			HTTPClient:     httpClient,
+			Retry:          config.Retry,
+			History:        config.History,
 			SystemMessage:  systemMessage,
 			MessageHistory: []Message{},
+			Model:          getEnv("CLAUDE_MODEL", claudeModel),
+			FallbackModel:  fallbackModel,
+			Usage:          config.Usage,
+			Prompt:         config.Prompt,
+			MaxTokens:      envInt("CLAUDE_MAX_TOKENS", claudeMaxTokens),
+			ThinkingBudget: loadClaudeThinkingBudget(),
 		}, nil
 	case "chatgpt":
 		log.Println("Initializing ChatGPT client")
 		return &ChatGPTClient{
-			APIKey:         config.AIAPIKey,
-			HTTPClient:     &http.Client{},
+			APIKey:         apiKey,
+			HTTPClient:     httpClient,
+			Retry:          config.Retry,
+			History:        config.History,
 			SystemMessage:  systemMessage,
 			MessageHistory: []Message{},
+			Model:          getEnv("CHATGPT_MODEL", chatGPTModel),
+			FallbackModel:  fallbackModel,
+			Usage:          config.Usage,
+			Prompt:         config.Prompt,
 		}, nil
 	case "deepseek":
 		log.Println("Initializing Deepseek client")
 		return &DeepseekClient{
-			APIKey:         config.AIAPIKey,
-			HTTPClient:     &http.Client{},
+			APIKey:         apiKey,
+			HTTPClient:     httpClient,
+			Retry:          config.Retry,
+			History:        config.History,
 			SystemMessage:  systemMessage,
 			MessageHistory: []Message{},
+			Model:          getEnv("DEEPSEEK_MODEL", deepseekModel),
+			FallbackModel:  fallbackModel,
+			Usage:          config.Usage,
+			Prompt:         config.Prompt,
 		}, nil
 	case "openrouter":
 		log.Println("Initializing OpenRouter client")
 		return &OpenRouterClient{
-			APIKey:         config.AIAPIKey,
-			HTTPClient:     &http.Client{},
+			APIKey:         apiKey,
+			HTTPClient:     httpClient,
+			Retry:          config.Retry,
+			History:        config.History,
 			SystemMessage:  systemMessage,
 			MessageHistory: []Message{},
+			Model:          getEnv("OPENROUTER_MODEL", openRouterModel),
+			FallbackModel:  fallbackModel,
+			Usage:          config.Usage,
+			Prompt:         config.Prompt,
 		}, nil
 	case "gemini":
 		log.Println("Initializing Gemini client")
 		return &GeminiClient{
-			APIKey:         config.AIAPIKey,
-			HTTPClient:     &http.Client{},
+			APIKey:         apiKey,
+			HTTPClient:     httpClient,
+			Retry:          config.Retry,
+			History:        config.History,
 			SystemMessage:  systemMessage,
 			MessageHistory: []Message{},
+			Model:          getEnv("GEMINI_MODEL", geminiModel),
+			FallbackModel:  fallbackModel,
+			Usage:          config.Usage,
+			Prompt:         config.Prompt,
 		}, nil
 	case "glm":
 		log.Println("Initializing GLM client")
 		return &GLMClient{
-			APIKey:         config.AIAPIKey,
-			HTTPClient:     &http.Client{},
+			APIKey:         apiKey,
+			HTTPClient:     httpClient,
+			Retry:          config.Retry,
+			History:        config.History,
 			SystemMessage:  systemMessage,
 			MessageHistory: []Message{},
+			Model:          getEnv("GLM_MODEL", glmModel),
+			FallbackModel:  fallbackModel,
+			Usage:          config.Usage,
+			Prompt:         config.Prompt,
 			UseCodingPlan:  true, // Set to true if using GLM Coding Plan subscription
 		}, nil
+	case "local":
+		log.Println("Initializing local client")
+		return &LocalClient{
+			APIKey:         apiKey,
+			HTTPClient:     httpClient,
+			Retry:          config.Retry,
+			History:        config.History,
+			SystemMessage:  systemMessage,
+			MessageHistory: []Message{},
+			Endpoint:       getEnv("LOCAL_AI_URL", localAPIEndpoint),
+			Model:          getEnv("LOCAL_AI_MODEL", localModel),
+			FallbackModel:  fallbackModel,
+			Usage:          config.Usage,
+			Prompt:         config.Prompt,
+		}, nil
 	default:
-		log.Printf("Unknown AI choice: %s", config.AIChoice)
-		return nil, fmt.Errorf("unknown AI choice: %s", config.AIChoice)
+		log.Printf("Unknown AI choice: %s", choice)
+		return nil, fmt.Errorf("unknown AI choice: %s", choice)
 	}
 }
 
@@ -344,11 +620,19 @@ func monitorChannels(ctx context.Context, api *tg.Client, config Config, aiClien
 	var batchDeadline time.Time
 
 	var mu sync.Mutex
+	airAttackActive := config.Usage.AlertActive() // Tracks alert transitions for per-alert usage totals
 	lastMessageIDs := make(map[string]int)
 	messageBuffer := []Message{} // Buffer to hold messages before sending to AI
 
 	// Initialize downloader
 	dl := downloader.NewDownloader()
+	pipeline := &ingestPipeline{
+		Images:     config.Images,
+		ImageDedup: newImageDedupCache(config.Images),
+		TextDedup:  newTextDedupCache(config.TextDedup),
+		Filter:     config.Filter,
+		Gazetteer:  config.Gazetteer,
+	}
 
 	log.Printf("Monitoring channels. UpdateInterval: %v, AIBatchInterval: %v, AIBatchExtendDuration: %v",
 		config.UpdateInterval, config.AIBatchInterval, config.AIBatchExtendDuration)
@@ -379,11 +663,20 @@ func monitorChannels(ctx context.Context, api *tg.Client, config Config, aiClien
 		case <-fetchTicker.C: // Fetch messages from Telegram
 			// Optional: Check air attack status if not ignored
 			if !config.IgnoreAirAttack {
-				isAirAttackActive, err := checkAirAttackStatus()
+				isAirAttackActive, alertTypes, err := checkAirAttackStatus()
 				if err != nil {
 					log.Printf("Error checking air attack status: %v", err)
 					continue // Skip this fetch cycle on error
 				}
+				config.Prompt.SetAlert(isAirAttackActive, alertTypes)
+				if isAirAttackActive != airAttackActive {
+					airAttackActive = isAirAttackActive
+					if isAirAttackActive {
+						config.Usage.StartAlert()
+					} else {
+						config.Usage.EndAlert()
+					}
+				}
 				if !isAirAttackActive {
 					continue
 				}
@@ -398,7 +691,7 @@ func monitorChannels(ctx context.Context, api *tg.Client, config Config, aiClien
 				}
 
 				mu.Lock() // Lock needed for lastMessageIDs access
-				newMessages, err := processNewMessages(ctx, api, dl, channelInfo.Identifier, messages, lastMessageIDs)
+				newMessages, err := processNewMessages(ctx, api, dl, channelInfo.Identifier, messages, lastMessageIDs, pipeline)
 				mu.Unlock()
 
 				if err != nil {
@@ -418,8 +711,8 @@ func monitorChannels(ctx context.Context, api *tg.Client, config Config, aiClien
 					for _, msg := range newMessages {
 						cleanedMsg := cleanString(msg.Content)
 						if len(cleanedMsg) > 0 || len(msg.Images) > 0 {
-							// Update content with channel info
-							msg.Content = fmt.Sprintf("Message from %s:\n%s", channelInfo.Identifier, cleanedMsg)
+							// The channel header is added from Sources when the batch is merged
+							msg.Content = cleanedMsg
 							newlyFetchedMessages = append(newlyFetchedMessages, msg)
 						}
 					}
@@ -429,7 +722,9 @@ func monitorChannels(ctx context.Context, api *tg.Client, config Config, aiClien
 			// Add newly fetched messages and manage the batch timer
 			if len(newlyFetchedMessages) > 0 {
 				mu.Lock()
-				messageBuffer = append(messageBuffer, newlyFetchedMessages...)
+				for _, msg := range newlyFetchedMessages {
+					messageBuffer = collapseRepost(messageBuffer, msg, pipeline.TextDedup)
+				}
 				bufferImageCount := 0
 				for _, msg := range messageBuffer {
 					bufferImageCount += len(msg.Images)
@@ -497,7 +792,7 @@ func monitorChannels(ctx context.Context, api *tg.Client, config Config, aiClien
 			mu.Unlock()
 
 			// Merge messages and send to AI
-			mergedMessage := mergeMessages(messagesToSend)
+			mergedMessage := capBatchImages(mergeMessages(messagesToSend), config.Images.MaxPerBatch)
 			if err := handleAIInteraction(ctx, api, config, aiClient, mergedMessage); err != nil {
 				log.Printf("Error handling AI interaction: %v", err)
 			}
@@ -525,20 +820,61 @@ func handleAIInteraction(ctx context.Context, api *tg.Client, config Config, aiC
 
 	// Clean the text content but keep images
 	message.Content = cleanString(message.Content)
+	// A withheld post is still in the model's history as announced, correct that first
+	if note := config.Prompt.TakeWithheldNote(); note != "" {
+		message.Content = note + "\n\n" + message.Content
+	}
+
+	// Persist whatever the exchange added to the history, including failed attempts
+	defer saveHistory(config.HistoryStore, aiClient, config.AIChoice)
+
+	exchange := ExchangeRecord{Time: time.Now(), Provider: config.AIChoice, Prompts: applyPrompts(config, aiClient)}
+	defer func() { config.Exchanges.Record(exchange) }()
+	log.Printf("Prompts: %v", exchange.Prompts)
 
 	aiResponse, err := aiClient.SendMessage(ctx, message)
 	if err != nil {
+		exchange.Error = err.Error()
 		return fmt.Errorf("error sending message to AI: %v", err)
 	}
 
 	log.Printf("AI Response: %+v", aiResponse)
+
+	aiResponse, err = validateWithRepair(ctx, aiClient, config.Validation, aiResponse)
+	exchange.Response = &aiResponse
+	if err != nil {
+		exchange.Error = err.Error()
+		log.Printf("Dropping AI response: %v", err)
+		return nil
+	}
 	fmt.Println("----------------------------------------------------")
 	if config.EnableTelegramSend {
 		formattedResponse := formatAIResponse(aiResponse)
-		fmt.Println("Sending message to Telegram...")
+		log.Println("Publishing message...")
 		if aiResponse.StatusChanged {
-			if err := sendToTelegram(ctx, api, sendToChannel, formattedResponse, !aiResponse.Danger); err != nil {
-				log.Printf("Error sending message to Telegram: %v", err)
+			alert := config.Prompt.Data()
+			post := Post{
+				Time:          time.Now(),
+				Danger:        aiResponse.Danger,
+				Text:          formattedResponse,
+				Response:      aiResponse,
+				Alert:         alert.Alert,
+				AlertTypes:    alert.AlertTypes,
+				AlertDuration: alert.AlertDuration,
+				Sources:       message.Sources,
+			}
+			switch reason := config.PublishGuard.Check(post); reason {
+			case "":
+				exchange.ReviewID, exchange.PublishedTo = releasePost(ctx, config, post)
+				exchange.Published = len(exchange.PublishedTo) > 0
+			case guardRate:
+				// Published once the rate limit allows, unless a newer post supersedes it
+				exchange.Suppressed = reason
+				config.PublishGuard.Defer(post, func(post Post) {
+					releasePost(ctx, config, post)
+				})
+			default:
+				exchange.Suppressed = reason
 			}
 		} else {
 			log.Printf("Status not changed, skipping message send")
@@ -549,10 +885,38 @@ func handleAIInteraction(ctx context.Context, api *tg.Client, config Config, aiC
 	return nil
 }
 
-func checkAirAttackStatus() (bool, error) {
+// releasePost submits the post for review when approval is required and publishes
+// it otherwise. It returns the review ID or the sinks that published the post.
+func releasePost(ctx context.Context, config Config, post Post) (string, []string) {
+	if config.Approval.Required(post) {
+		// Published later, if at all, once the post is reviewed
+		return config.Approval.Submit(ctx, post, func(post Post) []string {
+			return publishPost(ctx, config, post)
+		}, func(post Post, decision string) {
+			config.Prompt.SetWithheld(post.Response, "the reviewer's decision was "+decision)
+		}), nil
+	}
+	return "", publishPost(ctx, config, post)
+}
+
+// publishPost sends the post to every sink and returns the sinks that published it.
+func publishPost(ctx context.Context, config Config, post Post) []string {
+	publishedTo, err := config.Publishers.Publish(ctx, post)
+	if err != nil {
+		log.Printf("Error publishing message: %v", err)
+	}
+	if len(publishedTo) > 0 {
+		config.Prompt.SetPublished(post.Response)
+		config.PublishGuard.Record(post)
+	}
+	return publishedTo
+}
+
+// checkAirAttackStatus reports whether an air alert is active and lists all active alert types.
+func checkAirAttackStatus() (bool, []string, error) {
 	resp, err := http.Get("https://siren.pp.ua/api/v3/alerts/964")
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
 	defer resp.Body.Close()
 
@@ -562,17 +926,22 @@ func checkAirAttackStatus() (bool, error) {
 		} `json:"activeAlerts"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&alertResp); err != nil {
-		return false, err
+		return false, nil, err
 	}
 
+	airAlert := false
+	var types []string
 	for _, region := range alertResp {
 		for _, alert := range region.ActiveAlerts {
 			if alert.Type == "AIR" {
-				return true, nil
+				airAlert = true
+			}
+			if !slices.Contains(types, alert.Type) {
+				types = append(types, alert.Type)
 			}
 		}
 	}
-	return false, nil
+	return airAlert, types, nil
 }
 
 func getMessages(ctx context.Context, api *tg.Client, channelInfo ChannelInfo, limit int) ([]tg.MessageClass, error) {
@@ -692,7 +1061,16 @@ func downloadImageWithRetry(ctx context.Context, api *tg.Client, dl *downloader.
 	return Image{}, lastErr
 }
 
-func processNewMessages(ctx context.Context, api *tg.Client, dl *downloader.Downloader, channelID string, messages []tg.MessageClass, lastMessageIDs map[string]int) ([]Message, error) {
+// ingestPipeline holds the stages a channel post passes before it is buffered for the AI.
+type ingestPipeline struct {
+	Images     ImagePolicy
+	ImageDedup *ImageDedupCache
+	TextDedup  *TextDedupCache
+	Filter     *MessageFilter
+	Gazetteer  *Gazetteer
+}
+
+func processNewMessages(ctx context.Context, api *tg.Client, dl *downloader.Downloader, channelID string, messages []tg.MessageClass, lastMessageIDs map[string]int, pipeline *ingestPipeline) ([]Message, error) {
 	var newMessages []Message
 	latestMessageID := lastMessageIDs[channelID]
 
@@ -703,31 +1081,49 @@ func processNewMessages(ctx context.Context, api *tg.Client, dl *downloader.Down
 		}
 
 		if msg.ID > latestMessageID {
+			if msg.ID > lastMessageIDs[channelID] {
+				lastMessageIDs[channelID] = msg.ID
+			}
+
+			// Filtered before the photo download so dropped chatter costs nothing
+			_, hasPhoto := msg.Media.(*tg.MessageMediaPhoto)
+			text := cleanString(msg.Message)
+			if !pipeline.Filter.Allow(channelID, text, hasPhoto) {
+				continue
+			}
+
 			date := int64(msg.GetDate())
 			unixTimeUTC := time.Unix(date, 0)
 			unitTimeInRFC3339 := unixTimeUTC.Format("15:04:05")
 
-			content := unitTimeInRFC3339 + "\n" + msg.Message
+			locations := pipeline.Gazetteer.Places(text)
+			content := unitTimeInRFC3339 + "\n" + msg.Message + locationNote(locations)
 			var images []Image
 
 			// Check for media
 			if media, ok := msg.Media.(*tg.MessageMediaPhoto); ok {
 				if photo, ok := media.Photo.(*tg.Photo); ok {
 					if img, err := downloadImageWithRetry(ctx, api, dl, photo, msg.ID, 3); err == nil {
-						images = append(images, img)
+						if img, err = preprocessImage(img, pipeline.Images); err != nil {
+							log.Printf("Skipping image from message %d: %v", msg.ID, err)
+						} else if firstChannel, dup := pipeline.ImageDedup.Check(img.Hash, channelID); dup {
+							// The model already gets this photo, only tell it the repost exists
+							content += fmt.Sprintf("\n[same image as from %s]", firstChannel)
+						} else {
+							images = append(images, img)
+						}
 					}
 				}
 			}
 
 			newMessages = append(newMessages, Message{
-				Role:    "user",
-				Content: content,
-				Images:  images,
+				Role:      "user",
+				Content:   content,
+				Images:    images,
+				Sources:   []MessageSource{{Channel: channelID, MessageID: msg.ID}},
+				Shingles:  pipeline.TextDedup.Fingerprint(text),
+				Locations: locationNames(locations),
 			})
-
-			if msg.ID > lastMessageIDs[channelID] {
-				lastMessageIDs[channelID] = msg.ID
-			}
 		}
 	}
 
@@ -737,26 +1133,54 @@ func processNewMessages(ctx context.Context, api *tg.Client, dl *downloader.Down
 func mergeMessages(messages []Message) Message {
 	var mergedText strings.Builder
 	var allImages []Image
+	var sources []MessageSource
+	var locations []string
 
 	for i, msg := range messages {
 		if i > 0 {
 			mergedText.WriteString("\n\n")
 		}
+		mergedText.WriteString(sourceHeader(msg))
 		mergedText.WriteString(msg.Content)
 		allImages = append(allImages, msg.Images...)
+		sources = append(sources, msg.Sources...)
+		for _, location := range msg.Locations {
+			if !slices.Contains(locations, location) {
+				locations = append(locations, location)
+			}
+		}
 	}
 
 	return Message{
-		Role:    "user",
-		Content: mergedText.String(),
-		Images:  allImages,
+		Role:      "user",
+		Content:   mergedText.String(),
+		Images:    allImages,
+		Sources:   sources,
+		Locations: locations,
 	}
 }
 
-func sendToTelegram(ctx context.Context, api *tg.Client, channelUsername, message string, silent bool) error {
+func sendToTelegram(ctx context.Context, api *tg.Client, channelUsername, message string, entities []tg.MessageEntityClass, silent bool) error {
+	channel, err := resolveChannel(ctx, api, channelUsername)
+	if err != nil {
+		return err
+	}
+
+	_, err = api.MessagesSendMessage(ctx, &tg.MessagesSendMessageRequest{
+		Peer:     channel.AsInputPeer(),
+		Message:  message,
+		Entities: entities,
+		RandomID: rand.Int63(),
+		Silent:   silent,
+	})
+
+	return err
+}
+
+func resolveChannel(ctx context.Context, api *tg.Client, channelUsername string) (*tg.Channel, error) {
 	resolvedPeer, err := api.ContactsResolveUsername(ctx, channelUsername)
 	if err != nil {
-		return fmt.Errorf("failed to resolve username: %v", err)
+		return nil, fmt.Errorf("failed to resolve username: %v", err)
 	}
 
 	var channel *tg.Channel
@@ -768,17 +1192,9 @@ func sendToTelegram(ctx context.Context, api *tg.Client, channelUsername, messag
 	}
 
 	if channel == nil {
-		return fmt.Errorf("channel not found")
+		return nil, fmt.Errorf("channel not found")
 	}
-
-	_, err = api.MessagesSendMessage(ctx, &tg.MessagesSendMessageRequest{
-		Peer:     channel.AsInputPeer(),
-		Message:  message,
-		RandomID: rand.Int63(),
-		Silent:   silent,
-	})
-
-	return err
+	return channel, nil
 }
 
 func formatAIResponse(response AIJSONResponse) string {
@@ -786,7 +1202,13 @@ func formatAIResponse(response AIJSONResponse) string {
 	if response.Danger {
 		emoji = "🚨"
 	}
-	return fmt.Sprintf("%s %s", emoji, response.Text)
+	formatted := fmt.Sprintf("%s %s", emoji, response.Text)
+	if response.Danger {
+		for _, threat := range response.Threats {
+			formatted += "\n" + formatThreat(threat)
+		}
+	}
+	return formatted
 }
 
 func cleanString(input string) string {
@@ -1,21 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
-	"math"
 	"net/http"
 	"strings"
-	"time"
-)
-
-const (
-	maxRetries = 3
-	baseDelay  = 2 * time.Second
 )
 
 type OpenRouterResponse struct {
@@ -26,108 +17,120 @@ type OpenRouterResponse struct {
 	} `json:"choices"`
 	Error struct {
 		Message string `json:"message"`
+		Code    int    `json:"code"`
 	} `json:"error"`
+	Usage openAIUsage `json:"usage"`
 }
 
+// openRouterModel is the default OpenRouter model, override with OPENROUTER_MODEL
+const openRouterModel = "google/gemini-2.5-pro-exp-03-25:free"
+
 // AddMessageToHistory adds a message to the client's history, maintaining max history size.
 func (c *OpenRouterClient) AddMessageToHistory(message Message) {
-	c.MessageHistory = append(c.MessageHistory, message)
-	if len(c.MessageHistory) > maxMessageHistory {
-		c.MessageHistory = c.MessageHistory[1:] // Remove the oldest message
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = appendHistory(c.MessageHistory, message, c.History)
 }
 
-// GetMessageHistory returns the current message history.
+// GetMessageHistory returns a copy of the current message history.
 func (c *OpenRouterClient) GetMessageHistory() []Message {
-	return c.MessageHistory
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return copyHistory(c.MessageHistory)
+}
+
+// SetSystemMessage replaces the system message used for subsequent requests.
+func (c *OpenRouterClient) SetSystemMessage(systemMessage string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SystemMessage = systemMessage
+}
+
+// ForgetRepair removes a validation repair exchange from the history.
+func (c *OpenRouterClient) ForgetRepair(request string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.MessageHistory = withoutRepair(c.MessageHistory, request)
 }
 
 // SendMessage implements AIClient.SendMessage for openrouter.ai
 func (c *OpenRouterClient) SendMessage(ctx context.Context, message Message) (AIJSONResponse, error) {
-	var lastError error
+	// Requests on one client are serialized so the conversation stays in order
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
 	// Add message to history
 	c.AddMessageToHistory(message)
+	history := prepareHistory(ctx, &c.mu, &c.MessageHistory, c.History, "openrouter")
+	c.mu.Lock()
+	systemMessage := c.SystemMessage
+	c.mu.Unlock()
+
+	model, textOnly := c.Usage.SelectModel("openrouter", c.Model, c.FallbackModel)
+	if textOnly {
+		history = withoutImages(history)
+	}
 
-	for attempt := 0; attempt < maxRetries; attempt++ {
-		if attempt > 0 {
-			delay := time.Duration(math.Pow(2, float64(attempt-1))) * baseDelay
-			fmt.Printf("Retrying request (attempt %d/%d) after %v delay...\n", attempt+1, maxRetries, delay)
-			time.Sleep(delay)
-		}
+	var apiMessages []map[string]interface{}
 
-		var apiMessages []map[string]interface{}
-
-		// System message
-		apiMessages = append(apiMessages, map[string]interface{}{
-			"role":    "system",
-			"content": c.SystemMessage + "\nCurrent time: " + time.Now().Format("15:04:05"),
-		})
-
-		// History messages
-		for _, msg := range c.MessageHistory {
-			if len(msg.Images) > 0 {
-				var contentParts []map[string]interface{}
-				
-				// Add text
-				if msg.Content != "" {
-					contentParts = append(contentParts, map[string]interface{}{
-						"type": "text",
-						"text": msg.Content,
-					})
-				}
-
-				// Add images
-				for _, img := range msg.Images {
-					contentParts = append(contentParts, map[string]interface{}{
-						"type": "image_url",
-						"image_url": map[string]string{
-							"url": fmt.Sprintf("data:%s;base64,%s", img.MIMEType, base64.StdEncoding.EncodeToString(img.Data)),
-						},
-					})
-				}
-
-				apiMessages = append(apiMessages, map[string]interface{}{
-					"role":    msg.Role,
-					"content": contentParts,
-				})
-			} else {
-				apiMessages = append(apiMessages, map[string]interface{}{
-					"role":    msg.Role,
-					"content": msg.Content,
+	// System message
+	apiMessages = append(apiMessages, map[string]interface{}{
+		"role":    "system",
+		"content": c.Prompt.Render(systemMessage).String(),
+	})
+
+	// History messages
+	for _, msg := range history {
+		if len(msg.Images) > 0 {
+			var contentParts []map[string]interface{}
+
+			// Add text
+			if msg.Content != "" {
+				contentParts = append(contentParts, map[string]interface{}{
+					"type": "text",
+					"text": msg.Content,
 				})
 			}
-		}
-
-		reqBody, err := json.Marshal(map[string]interface{}{
-			"model":    "google/gemini-2.5-pro-exp-03-25:free",
-			"messages": apiMessages,
-		})
-		if err != nil {
-			return AIJSONResponse{}, fmt.Errorf("marshaling request error: %w", err)
-		}
 
-		url := "https://openrouter.ai/api/v1/chat/completions"
+			// Add images
+			for _, img := range msg.Images {
+				contentParts = append(contentParts, map[string]interface{}{
+					"type": "image_url",
+					"image_url": map[string]string{
+						"url": fmt.Sprintf("data:%s;base64,%s", img.MIMEType, base64.StdEncoding.EncodeToString(img.Data)),
+					},
+				})
+			}
 
-		fmt.Printf("Sending request to OpenRouter (attempt %d/%d)\n", attempt+1, maxRetries)
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(reqBody))
-		if err != nil {
-			return AIJSONResponse{}, fmt.Errorf("creating request error: %w", err)
+			apiMessages = append(apiMessages, map[string]interface{}{
+				"role":    msg.Role,
+				"content": contentParts,
+			})
+		} else {
+			apiMessages = append(apiMessages, map[string]interface{}{
+				"role":    msg.Role,
+				"content": msg.Content,
+			})
 		}
+	}
 
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.APIKey))
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"model":           model,
+		"messages":        apiMessages,
+		"response_format": aiResponseFormat(),
+	})
+	if err != nil {
+		return AIJSONResponse{}, fmt.Errorf("marshaling request error: %w", err)
+	}
 
-		resp, err := c.HTTPClient.Do(req)
-		if err != nil {
-			lastError = fmt.Errorf("sending request error: %w", err)
-			continue
-		}
-		defer resp.Body.Close()
+	url := "https://openrouter.ai/api/v1/chat/completions"
+	headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", c.APIKey)}
 
-		body, err := io.ReadAll(resp.Body)
+	var aiResp AIJSONResponse
+	err = c.Retry.Do(ctx, "OpenRouter", func(ctx context.Context) error {
+		body, err := postJSON(ctx, c.HTTPClient, "OpenRouter", url, headers, reqBody)
 		if err != nil {
-			lastError = fmt.Errorf("reading response error: %w", err)
-			continue
+			return err
 		}
 
 		// Clean the response body by removing any leading/trailing whitespace
@@ -137,38 +140,34 @@ func (c *OpenRouterClient) SendMessage(ctx context.Context, message Message) (AI
 		// Parse OpenRouter response
 		var openRouterResp OpenRouterResponse
 		if err := json.Unmarshal(body, &openRouterResp); err != nil {
-			lastError = fmt.Errorf("parsing response error: %w, body: %s", err, string(body))
-			continue
+			return malformed(fmt.Errorf("parsing response error: %w, body: %s", err, string(body)))
 		}
+		c.Usage.Record("openrouter", model, openRouterResp.Usage.tokenUsage(history, "openrouter"))
 
+		// OpenRouter reports upstream failures inside a 200 response, carrying the upstream status code
 		if openRouterResp.Error.Message != "" {
-			lastError = fmt.Errorf("api error: %s", openRouterResp.Error.Message)
-			continue
+			statusCode := openRouterResp.Error.Code
+			if statusCode == 0 {
+				statusCode = http.StatusBadGateway
+			}
+			return &APIError{Provider: "OpenRouter", StatusCode: statusCode, Body: openRouterResp.Error.Message}
 		}
 
 		if len(openRouterResp.Choices) == 0 {
-			lastError = fmt.Errorf("empty choices in response")
-			continue
+			return malformed(fmt.Errorf("empty choices in response"))
 		}
 
-		content := openRouterResp.Choices[0].Message.Content
-		
-		// Clean content
-		content = strings.TrimSpace(content)
-		content = strings.TrimPrefix(content, "```json")
-		content = strings.TrimPrefix(content, "```")
-		content = strings.TrimSuffix(content, "```")
-		content = strings.TrimSpace(content)
-
-		var aiResp AIJSONResponse
-		if err := json.Unmarshal([]byte(content), &aiResp); err != nil {
-			lastError = fmt.Errorf("parsing ai response error: %w, content: %s", err, content)
-			continue
+		// Not every model behind OpenRouter honours response_format, so use the tolerant extractor
+		aiResp, err = parseAIJSON(openRouterResp.Choices[0].Message.Content)
+		if err != nil {
+			return malformed(fmt.Errorf("parsing ai response error: %w", err))
 		}
-
-		c.AddMessageToHistory(Message{Role: "assistant", Content: fmt.Sprintf("%s Danger: %v StatusChanged: %v", aiResp.Text, aiResp.Danger, aiResp.StatusChanged)})
-		return aiResp, nil
+		return nil
+	})
+	if err != nil {
+		return AIJSONResponse{}, err
 	}
 
-	return AIJSONResponse{}, fmt.Errorf("failed after %d retries: %w", maxRetries, lastError)
+	c.AddMessageToHistory(Message{Role: "assistant", Content: fmt.Sprintf("%s Danger: %v StatusChanged: %v", aiResp.Text, aiResp.Danger, aiResp.StatusChanged)})
+	return aiResp, nil
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/telegram/message/entity"
+	"github.com/gotd/td/telegram/message/html"
+	"github.com/gotd/td/tg"
+)
+
+const (
+	defaultOutputTemplatesDir = "config/templates"
+	// defaultOutputTemplate is used by sinks that name no template
+	defaultOutputTemplate = "default"
+)
+
+// FormattedText is a post with its Telegram formatting entities; sinks other
+// than Telegram use the text alone.
+type FormattedText struct {
+	Text     string
+	Entities []tg.MessageEntityClass
+}
+
+// SourceLink is a channel post the published status is based on.
+type SourceLink struct {
+	Channel   string
+	MessageID int
+	URL       string
+}
+
+// OutputData is the data output templates are rendered with. The AI response
+// fields are promoted, e.g. {{.Text}}, {{.Danger}} and {{range .Threats}}.
+type OutputData struct {
+	AIJSONResponse
+	Time time.Time
+	// Formatted is the built-in rendering of the post
+	Formatted     string
+	Alert         bool
+	AlertTypes    []string
+	AlertDuration string
+	// Links are the source posts, Channels their distinct channels
+	Links    []SourceLink
+	Channels []string
+}
+
+// outputTemplateFile is a cached template file; a missing file has a nil template.
+type outputTemplateFile struct {
+	tmpl    *template.Template
+	modTime time.Time
+}
+
+// OutputTemplates renders posts from Dir/<name>.tmpl, or <name>.danger.tmpl for
+// danger posts when it exists. Templates are html/template files using the
+// Telegram subset of HTML (<b>, <i>, <u>, <s>, <a href>, <code>, <pre>,
+// <tg-spoiler>) and are re-read when they change. A nil set renders nothing.
+type OutputTemplates struct {
+	Dir string
+
+	mu    sync.Mutex
+	files map[string]outputTemplateFile
+}
+
+// loadOutputTemplates returns the templates in OUTPUT_TEMPLATES_DIR. Without
+// the directory posts keep the built-in format and nil is returned.
+func loadOutputTemplates() *OutputTemplates {
+	dir := getEnv("OUTPUT_TEMPLATES_DIR", defaultOutputTemplatesDir)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil
+	}
+	log.Printf("Output templates: %s", dir)
+	return &OutputTemplates{Dir: dir, files: make(map[string]outputTemplateFile)}
+}
+
+// get returns the current template of a file, nil when the file does not exist.
+// An edit that fails to parse keeps the last good template.
+func (t *OutputTemplates) get(file string) *template.Template {
+	path := filepath.Join(t.Dir, file)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cached, ok := t.files[file]
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading output template %s: %v", path, err)
+			return cached.tmpl
+		}
+		delete(t.files, file)
+		return nil
+	}
+	if ok && info.ModTime().Equal(cached.modTime) {
+		return cached.tmpl
+	}
+
+	content, err := os.ReadFile(path)
+	if err == nil {
+		var tmpl *template.Template
+		tmpl, err = template.New(file).Funcs(outputTemplateFuncs).Option("missingkey=error").Parse(string(content))
+		if err == nil {
+			t.files[file] = outputTemplateFile{tmpl: tmpl, modTime: info.ModTime()}
+			log.Printf("Loaded output template %s", path)
+			return tmpl
+		}
+	}
+	log.Printf("Error loading output template %s, keeping the previous version: %v", path, err)
+	// Remember the broken version so the error is logged once per edit
+	t.files[file] = outputTemplateFile{tmpl: cached.tmpl, modTime: info.ModTime()}
+	return cached.tmpl
+}
+
+var outputTemplateFuncs = template.FuncMap{
+	"join":   strings.Join,
+	"threat": formatThreat,
+	"local": func(t time.Time) time.Time {
+		return t.In(promptLocation)
+	},
+}
+
+// Render renders the post with the named template. It reports false when
+// there is no such template or it fails, then the post keeps its plain text.
+func (t *OutputTemplates) Render(name string, post Post) (FormattedText, bool) {
+	if t == nil {
+		return FormattedText{}, false
+	}
+	if name == "" {
+		name = defaultOutputTemplate
+	}
+	var tmpl *template.Template
+	if post.Danger {
+		tmpl = t.get(name + ".danger.tmpl")
+	}
+	if tmpl == nil {
+		tmpl = t.get(name + ".tmpl")
+	}
+	if tmpl == nil {
+		return FormattedText{}, false
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, newOutputData(post)); err != nil {
+		log.Printf("Error rendering output template %s: %v", tmpl.Name(), err)
+		return FormattedText{}, false
+	}
+	formatted, err := telegramHTML(strings.TrimSpace(buf.String()))
+	if err != nil {
+		log.Printf("Error parsing output of template %s: %v", tmpl.Name(), err)
+		return FormattedText{}, false
+	}
+	return formatted, true
+}
+
+func newOutputData(post Post) OutputData {
+	data := OutputData{
+		AIJSONResponse: post.Response,
+		Time:           post.Time,
+		Formatted:      post.Text,
+		Alert:          post.Alert,
+		AlertTypes:     post.AlertTypes,
+		AlertDuration:  post.AlertDuration,
+	}
+	for _, source := range post.Sources {
+		data.Links = append(data.Links, SourceLink{Channel: source.Channel, MessageID: source.MessageID, URL: sourceURL(source)})
+		if !slices.Contains(data.Channels, source.Channel) {
+			data.Channels = append(data.Channels, source.Channel)
+		}
+	}
+	return data
+}
+
+// sourceURL links a channel post; private channels are addressed by ID.
+func sourceURL(source MessageSource) string {
+	channel := source.Channel
+	if _, err := strconv.ParseInt(channel, 10, 64); err == nil {
+		channel = "c/" + strings.TrimPrefix(channel, "-100")
+	}
+	return fmt.Sprintf("https://t.me/%s/%d", channel, source.MessageID)
+}
+
+// telegramHTML converts Telegram-style HTML to text and message entities.
+func telegramHTML(source string) (FormattedText, error) {
+	var builder entity.Builder
+	if err := html.HTML(strings.NewReader(source), &builder, html.Options{}); err != nil {
+		return FormattedText{}, err
+	}
+	text, entities := builder.Complete()
+	return FormattedText{Text: text, Entities: entities}, nil
+}
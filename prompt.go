@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	_ "time/tzdata" // The alpine runtime image has no zoneinfo
+	"unicode/utf8"
+)
+
+// promptTimeZone is the zone of all times shown to the model.
+const promptTimeZone = "Europe/Kyiv"
+
+// defaultSystemMessageMaxBytes bounds the system message file, a runaway file
+// would be resent with every request
+const defaultSystemMessageMaxBytes = 64 * 1024
+
+// promptVersionVar exposes the active system message version on /debug/vars
+var promptVersionVar = expvar.NewString("prompt_version")
+
+var promptLocation = loadPromptLocation()
+
+func loadPromptLocation() *time.Location {
+	location, err := time.LoadLocation(promptTimeZone)
+	if err != nil {
+		log.Printf("Error loading time zone %s, using UTC: %v", promptTimeZone, err)
+		return time.UTC
+	}
+	return location
+}
+
+// PromptData is the data system_message.txt is rendered with, e.g.
+// "Зараз {{.Time}}{{if .Alert}}, тривога {{.AlertDuration}}{{end}}".
+type PromptData struct {
+	// Now is the current time in Europe/Kyiv; Date and Time are its formatted parts
+	Now  time.Time
+	Date string
+	Time string
+	// Alert tells whether an air alert is active; AlertTypes lists all active alert types
+	Alert      bool
+	AlertTypes []string
+	// AlertSince and AlertDuration describe the active alert, zero without one
+	AlertSince    time.Time
+	AlertDuration string
+	// Channels lists the monitored channels
+	Channels []string
+	// LastStatus is the text of the last published post, LastDanger its verdict and
+	// LastPublished its time; LastStatus is empty before the first post
+	LastStatus    string
+	LastDanger    bool
+	LastPublished time.Time
+}
+
+// SystemPrompt is a rendered system message. Static is identical between
+// requests and can be cached by providers; Dynamic changes with every request.
+type SystemPrompt struct {
+	Static  string
+	Dynamic string
+}
+
+func (p SystemPrompt) String() string {
+	if p.Static == "" || p.Dynamic == "" {
+		return p.Static + p.Dynamic
+	}
+	return p.Static + "\n" + p.Dynamic
+}
+
+// PromptState holds the runtime values shared by every provider's system prompt.
+type PromptState struct {
+	mu            sync.Mutex
+	channels      []string
+	alert         bool
+	alertTypes    []string
+	alertSince    time.Time
+	lastStatus    string
+	lastDanger    bool
+	lastPublished time.Time
+	version       string
+	templates     map[string]*template.Template
+	// withheld describes an announced post that was not published, until the model is told
+	withheld string
+}
+
+func newPromptState(channels []ChannelInfo) *PromptState {
+	state := &PromptState{templates: make(map[string]*template.Template)}
+	for _, channel := range channels {
+		state.channels = append(state.channels, channel.Identifier)
+	}
+	return state
+}
+
+// SetAlert records the current alert state; the start time is kept while the alert lasts.
+func (s *PromptState) SetAlert(active bool, types []string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if active && !s.alert {
+		s.alertSince = time.Now()
+	}
+	if !active {
+		s.alertSince = time.Time{}
+	}
+	s.alert = active
+	s.alertTypes = types
+}
+
+// SetVersion records the version of the active system message.
+func (s *PromptState) SetVersion(version string) {
+	promptVersionVar.Set(version)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version = version
+}
+
+// Version returns the version of the active system message.
+func (s *PromptState) Version() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+// SetPublished records the post that was last sent to the channel.
+func (s *PromptState) SetPublished(response AIJSONResponse) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastStatus = response.Text
+	s.lastDanger = response.Danger
+	s.lastPublished = time.Now()
+	s.withheld = ""
+}
+
+// SetWithheld records that a post the model announced was not published. The
+// model's history still holds the status change, so the next batch tells it the
+// channel shows the previous status.
+func (s *PromptState) SetWithheld(response AIJSONResponse, reason string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.withheld = fmt.Sprintf("Your status update %q was not published (%s).", response.Text, reason)
+}
+
+// TakeWithheldNote returns the note about a withheld post once, or "" when there is none.
+func (s *PromptState) TakeWithheldNote() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	note := s.withheld
+	if note == "" {
+		return ""
+	}
+	s.withheld = ""
+	if s.lastStatus == "" {
+		return note + " Nothing has been published to the channel yet."
+	}
+	return note + fmt.Sprintf(" The channel still shows the previous post %q (danger: %v), report status changes relative to it.", s.lastStatus, s.lastDanger)
+}
+
+// Data returns the values for the next render.
+func (s *PromptState) Data() PromptData {
+	now := time.Now().In(promptLocation)
+	data := PromptData{
+		Now:  now,
+		Date: now.Format("2006-01-02"),
+		Time: now.Format("15:04:05"),
+	}
+	if s == nil {
+		return data
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data.Alert = s.alert
+	data.AlertTypes = append([]string(nil), s.alertTypes...)
+	data.Channels = append([]string(nil), s.channels...)
+	if s.alert && !s.alertSince.IsZero() {
+		data.AlertSince = s.alertSince.In(promptLocation)
+		data.AlertDuration = time.Since(s.alertSince).Round(time.Minute).String()
+	}
+	data.LastStatus = s.lastStatus
+	data.LastDanger = s.lastDanger
+	if !s.lastPublished.IsZero() {
+		data.LastPublished = s.lastPublished.In(promptLocation)
+	}
+	return data
+}
+
+// Render executes the system message as a text/template. Messages without
+// template actions are sent unchanged with a current time line appended, as
+// before templating existed. A broken template is sent as plain text so the
+// bot keeps working while the file is being fixed.
+func (s *PromptState) Render(systemMessage string) SystemPrompt {
+	data := s.Data()
+	timeLine := fmt.Sprintf("Current time: %s %s (%s)", data.Date, data.Time, data.Now.Format("MST"))
+	if !strings.Contains(systemMessage, "{{") {
+		return SystemPrompt{Static: systemMessage, Dynamic: timeLine}
+	}
+
+	tmpl, err := s.parse(systemMessage)
+	if err != nil {
+		log.Printf("Error parsing system message template, sending it unrendered: %v", err)
+		return SystemPrompt{Static: systemMessage, Dynamic: timeLine}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Printf("Error rendering system message template, sending it unrendered: %v", err)
+		return SystemPrompt{Static: systemMessage, Dynamic: timeLine}
+	}
+	return SystemPrompt{Dynamic: buf.String()}
+}
+
+// parse returns the parsed template, cached by source text.
+func (s *PromptState) parse(source string) (*template.Template, error) {
+	if s == nil {
+		return parsePromptTemplate(source)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tmpl, ok := s.templates[source]; ok {
+		return tmpl, nil
+	}
+	tmpl, err := parsePromptTemplate(source)
+	if err != nil {
+		return nil, err
+	}
+	// Only the current prompt matters, older versions are dropped on reload
+	s.templates = map[string]*template.Template{source: tmpl}
+	return tmpl, nil
+}
+
+func parsePromptTemplate(source string) (*template.Template, error) {
+	return template.New("system_message").Funcs(template.FuncMap{
+		"join": strings.Join,
+	}).Option("missingkey=error").Parse(source)
+}
+
+// promptVersion identifies a system message by the start of its SHA-256.
+func promptVersion(systemMessage string) string {
+	sum := sha256.Sum256([]byte(systemMessage))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// validateSystemMessage rejects empty, oversized, non-UTF-8 and unparsable system messages.
+func validateSystemMessage(content []byte) error {
+	maxBytes := envInt("SYSTEM_MESSAGE_MAX_BYTES", defaultSystemMessageMaxBytes)
+	switch {
+	case len(bytes.TrimSpace(content)) == 0:
+		return fmt.Errorf("system message is empty")
+	case len(content) > maxBytes:
+		return fmt.Errorf("system message is %d bytes, the limit is %d", len(content), maxBytes)
+	case !utf8.Valid(content):
+		return fmt.Errorf("system message is not valid UTF-8")
+	}
+	if bytes.Contains(content, []byte("{{")) {
+		if _, err := parsePromptTemplate(string(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPromptsDir    = "config/prompts"
+	defaultPromptsConfig = "config/prompts.json"
+	// legacyPromptName names system_message.txt in exchange records when no library is configured
+	legacyPromptName = "system_message"
+)
+
+// PromptWeight is one arm of an A/B split.
+type PromptWeight struct {
+	Prompt string  `json:"prompt"`
+	Weight float64 `json:"weight"`
+}
+
+// PromptLibraryConfig is the content of config/prompts.json, e.g.
+//
+//	{"providers": {"claude": "strict"}, "split": [{"prompt": "v1", "weight": 80}, {"prompt": "v2", "weight": 20}]}
+//
+// Providers pins a prompt per provider; other providers draw an arm from Split,
+// or use Default when there is no split. A drawn arm is kept for
+// PROMPT_SPLIT_WINDOW and never replaced during an air alert, so a conversation
+// is not built from answers to different prompts.
+type PromptLibraryConfig struct {
+	Default   string            `json:"default"`
+	Providers map[string]string `json:"providers"`
+	Split     []PromptWeight    `json:"split"`
+}
+
+// promptFile is a cached prompt file.
+type promptFile struct {
+	content string
+	version string
+	modTime time.Time
+}
+
+// PromptArm is the split arm assigned to a provider, saved with its history.
+type PromptArm struct {
+	Prompt   string    `json:"prompt"`
+	Assigned time.Time `json:"assigned"`
+}
+
+// PromptLibrary serves named prompts from Dir/<name>.txt. Files are re-read when
+// they change, so editing a prompt needs no restart; an invalid edit keeps the
+// last good content.
+type PromptLibrary struct {
+	Dir    string
+	Config PromptLibraryConfig
+	// Window is how long a provider keeps its split arm
+	Window time.Duration
+
+	mu    sync.Mutex
+	files map[string]promptFile
+	arms  map[string]PromptArm
+}
+
+// SelectedPrompt is the prompt chosen for one provider in one exchange.
+type SelectedPrompt struct {
+	Name    string
+	Version string
+	Content string
+}
+
+// ID identifies the prompt in logs and exchange records as name@version.
+func (p SelectedPrompt) ID() string {
+	return p.Name + "@" + p.Version
+}
+
+// loadPromptLibrary reads PROMPTS_CONFIG. Without it the bot uses the single
+// system_message.txt and nil is returned.
+func loadPromptLibrary() (*PromptLibrary, error) {
+	path := getEnv("PROMPTS_CONFIG", defaultPromptsConfig)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading prompt library config: %v", err)
+	}
+
+	var config PromptLibraryConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing prompt library config %s: %v", path, err)
+	}
+	if config.Default == "" {
+		config.Default = "default"
+	}
+	library := &PromptLibrary{
+		Dir:    getEnv("PROMPTS_DIR", defaultPromptsDir),
+		Config: config,
+		Window: envDuration("PROMPT_SPLIT_WINDOW", 24*time.Hour),
+		files:  make(map[string]promptFile),
+		arms:   make(map[string]PromptArm),
+	}
+
+	// Fail at startup rather than on the first exchange when a referenced prompt is missing
+	names := []string{}
+	if len(config.Split) == 0 {
+		names = append(names, config.Default)
+	}
+	for _, arm := range config.Split {
+		if arm.Weight <= 0 {
+			return nil, fmt.Errorf("prompt %s has a non-positive split weight", arm.Prompt)
+		}
+		names = append(names, arm.Prompt)
+	}
+	for _, name := range config.Providers {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		prompt, err := library.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Prompt library: %s", prompt.ID())
+	}
+	return library, nil
+}
+
+// Get returns the current content of a named prompt.
+func (l *PromptLibrary) Get(name string) (SelectedPrompt, error) {
+	if strings.ContainsAny(name, `/\`) || name == "" {
+		return SelectedPrompt{}, fmt.Errorf("invalid prompt name %q", name)
+	}
+	path := filepath.Join(l.Dir, name+".txt")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cached, ok := l.files[name]
+
+	info, err := os.Stat(path)
+	if err == nil && ok && info.ModTime().Equal(cached.modTime) {
+		return SelectedPrompt{Name: name, Version: cached.version, Content: cached.content}, nil
+	}
+	if err == nil {
+		var content []byte
+		content, err = os.ReadFile(path)
+		if err == nil {
+			err = validateSystemMessage(content)
+		}
+		if err == nil {
+			cached = promptFile{content: string(content), version: promptVersion(string(content)), modTime: info.ModTime()}
+			l.files[name] = cached
+			return SelectedPrompt{Name: name, Version: cached.version, Content: cached.content}, nil
+		}
+	}
+	if ok {
+		log.Printf("Error reloading prompt %s, keeping version %s: %v", name, cached.version, err)
+		return SelectedPrompt{Name: name, Version: cached.version, Content: cached.content}, nil
+	}
+	return SelectedPrompt{}, fmt.Errorf("error loading prompt %s: %v", name, err)
+}
+
+// Select picks the prompt for a provider: its pinned prompt, its split arm, or
+// the default. It reports whether a new arm was drawn, which the caller saves
+// with the history. The arm is redrawn once Window has passed, but never while
+// an alert is active.
+func (l *PromptLibrary) Select(provider string, alert bool) (SelectedPrompt, bool, error) {
+	if name, ok := l.Config.Providers[strings.ToLower(provider)]; ok {
+		prompt, err := l.Get(name)
+		return prompt, false, err
+	}
+	if len(l.Config.Split) == 0 {
+		prompt, err := l.Get(l.Config.Default)
+		return prompt, false, err
+	}
+
+	l.mu.Lock()
+	arm, ok := l.arms[provider]
+	drawn := !ok || !l.inSplit(arm.Prompt) || (!alert && time.Since(arm.Assigned) >= l.Window)
+	if drawn {
+		arm = PromptArm{Prompt: l.draw(), Assigned: time.Now()}
+		l.arms[provider] = arm
+	}
+	l.mu.Unlock()
+
+	if drawn {
+		log.Printf("Prompt split: %s assigned %s", provider, arm.Prompt)
+	}
+	prompt, err := l.Get(arm.Prompt)
+	return prompt, drawn, err
+}
+
+// draw picks a split arm by weight.
+func (l *PromptLibrary) draw() string {
+	total := 0.0
+	for _, arm := range l.Config.Split {
+		total += arm.Weight
+	}
+	draw := rand.Float64() * total
+	for _, arm := range l.Config.Split {
+		draw -= arm.Weight
+		if draw < 0 {
+			return arm.Prompt
+		}
+	}
+	return l.Config.Split[len(l.Config.Split)-1].Prompt
+}
+
+// inSplit reports whether the prompt is still an arm of the split, which may have
+// changed since the arm was saved.
+func (l *PromptLibrary) inSplit(name string) bool {
+	for _, arm := range l.Config.Split {
+		if arm.Prompt == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Arm returns the split arm of a provider.
+func (l *PromptLibrary) Arm(provider string) (PromptArm, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	arm, ok := l.arms[provider]
+	return arm, ok
+}
+
+// restorePromptArms loads the split arms saved with the histories, so a restart
+// continues a conversation with the prompt it was built with.
+func restorePromptArms(store HistoryStore, library *PromptLibrary, aiClient AIClient, name string) {
+	if store == nil || library == nil {
+		return
+	}
+	for target := range historyTargets(aiClient, name) {
+		arm, err := store.LoadPromptArm(target)
+		if err != nil {
+			log.Printf("Error restoring prompt arm for %s: %v", target, err)
+			continue
+		}
+		if arm == nil {
+			continue
+		}
+		library.mu.Lock()
+		library.arms[target] = *arm
+		library.mu.Unlock()
+		log.Printf("Restored prompt arm %s for %s", arm.Prompt, target)
+	}
+}
+
+// applyPrompts sets the system message of every client for the next exchange and
+// returns the prompt used per provider. Without a library the prompts come from
+// system_message.txt, kept current by watchSystemMessageFile.
+func applyPrompts(config Config, aiClient AIClient) map[string]string {
+	used := make(map[string]string)
+	alert := config.Prompt.Data().Alert
+	for target, client := range historyTargets(aiClient, config.AIChoice) {
+		if config.Prompts == nil {
+			used[target] = SelectedPrompt{Name: legacyPromptName, Version: config.Prompt.Version()}.ID()
+			continue
+		}
+		prompt, drawn, err := config.Prompts.Select(target, alert)
+		if drawn && config.HistoryStore != nil {
+			arm, _ := config.Prompts.Arm(target)
+			if err := config.HistoryStore.SavePromptArm(target, arm); err != nil {
+				log.Printf("Error saving prompt arm for %s: %v", target, err)
+			}
+		}
+		if err != nil {
+			// The client keeps the prompt of its previous exchange
+			log.Printf("Error selecting prompt for %s: %v", target, err)
+			used[target] = "error"
+			continue
+		}
+		if setter, ok := client.(systemMessageSetter); ok {
+			setter.SetSystemMessage(prompt.Content)
+		}
+		used[target] = prompt.ID()
+	}
+
+	if config.Prompts != nil {
+		ids := make([]string, 0, len(used))
+		for _, id := range used {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		config.Prompt.SetVersion(strings.Join(ids, ","))
+	}
+	return used
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testPromptLibrary(t *testing.T, window time.Duration) *PromptLibrary {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{"v1": "Prompt one", "v2": "Prompt two"} {
+		if err := os.WriteFile(filepath.Join(dir, name+".txt"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &PromptLibrary{
+		Dir:    dir,
+		Config: PromptLibraryConfig{Split: []PromptWeight{{Prompt: "v1", Weight: 1}, {Prompt: "v2", Weight: 1}}},
+		Window: window,
+		files:  make(map[string]promptFile),
+		arms:   make(map[string]PromptArm),
+	}
+}
+
+func TestPromptLibrarySelectIsSticky(t *testing.T) {
+	library := testPromptLibrary(t, time.Hour)
+
+	first, drawn, err := library.Select("claude", false)
+	if err != nil || !drawn {
+		t.Fatalf("first Select = %v, drawn %v, want a new arm", err, drawn)
+	}
+	for i := 0; i < 50; i++ {
+		prompt, drawn, err := library.Select("claude", false)
+		if err != nil || drawn || prompt.Name != first.Name {
+			t.Fatalf("Select %d = %s (drawn %v, %v), want %s kept", i, prompt.Name, drawn, err, first.Name)
+		}
+	}
+}
+
+func TestPromptLibrarySelectWindow(t *testing.T) {
+	tests := []struct {
+		name      string
+		assigned  time.Duration
+		prompt    string
+		alert     bool
+		wantDrawn bool
+	}{
+		{name: "within the window", assigned: -time.Minute, prompt: "v2"},
+		{name: "window passed", assigned: -2 * time.Hour, prompt: "v2", wantDrawn: true},
+		{name: "window passed during an alert", assigned: -2 * time.Hour, prompt: "v2", alert: true},
+		{name: "arm removed from the split", assigned: -time.Minute, prompt: "v0", wantDrawn: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			library := testPromptLibrary(t, time.Hour)
+			library.arms["claude"] = PromptArm{Prompt: tt.prompt, Assigned: time.Now().Add(tt.assigned)}
+			prompt, drawn, err := library.Select("claude", tt.alert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if drawn != tt.wantDrawn {
+				t.Fatalf("drawn = %v, want %v", drawn, tt.wantDrawn)
+			}
+			if !drawn && prompt.Name != tt.prompt {
+				t.Fatalf("prompt = %s, want %s kept", prompt.Name, tt.prompt)
+			}
+		})
+	}
+}
+
+func TestPromptArmPersistence(t *testing.T) {
+	store := &FileHistoryStore{Dir: t.TempDir()}
+	if arm, err := store.LoadPromptArm("claude"); err != nil || arm != nil {
+		t.Fatalf("LoadPromptArm without a file = %v, %v", arm, err)
+	}
+	saved := PromptArm{Prompt: "v2", Assigned: time.Now().Round(time.Second)}
+	if err := store.SavePromptArm("claude", saved); err != nil {
+		t.Fatal(err)
+	}
+
+	library := testPromptLibrary(t, time.Hour)
+	restorePromptArms(store, library, &ClaudeClient{}, "Claude")
+	arm, ok := library.Arm("claude")
+	if !ok || arm.Prompt != saved.Prompt || !arm.Assigned.Equal(saved.Assigned) {
+		t.Fatalf("restored arm = %+v (%v), want %+v", arm, ok, saved)
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/tg"
+)
+
+const defaultSinksFile = "config/sinks.json"
+
+// Sink filters
+const (
+	sinkFilterAll    = "all"
+	sinkFilterDanger = "danger"
+)
+
+// Sink formats: the formatted post, the bare AI text, or the post as JSON
+const (
+	sinkFormatText  = "text"
+	sinkFormatPlain = "plain"
+	sinkFormatJSON  = "json"
+)
+
+// Post is one status update handed to every sink.
+type Post struct {
+	Time     time.Time      `json:"time"`
+	Danger   bool           `json:"danger"`
+	Text     string         `json:"text"`
+	Response AIJSONResponse `json:"response"`
+	// Alert tells whether an air alert is active, AlertDuration for how long
+	Alert         bool     `json:"alert"`
+	AlertTypes    []string `json:"alertTypes,omitempty"`
+	AlertDuration string   `json:"alertDuration,omitempty"`
+	// Sources are the channel posts the status is based on
+	Sources []MessageSource `json:"sources,omitempty"`
+}
+
+// Publisher delivers posts to one destination.
+type Publisher interface {
+	Name() string
+	Publish(ctx context.Context, post Post) error
+}
+
+// SinkConfig is one entry of config/sinks.json, e.g.
+//
+//	[{"type": "telegram", "channel": "odesair"},
+//	 {"type": "ntfy", "url": "https://ntfy.sh/odesair", "filter": "danger"},
+//	 {"type": "file", "path": "config/posts.jsonl"}]
+//
+// Only the fields of its type are used.
+type SinkConfig struct {
+	Type string `json:"type"`
+	// Name identifies the sink in logs, the type and target by default
+	Name string `json:"name"`
+	// Filter is "all" (every status change, the default) or "danger"
+	Filter string `json:"filter"`
+	// Format is "text", "plain" or "json"; webhooks always send JSON
+	Format string `json:"format"`
+	// Template names the output template of the text format, "default" when empty
+	Template string `json:"template"`
+
+	// Channel is the Telegram channel username; Map attaches the threat map (default true)
+	Channel string `json:"channel"`
+	Map     *bool  `json:"map"`
+	// Live edits one pinned status message instead of posting every change
+	Live bool `json:"live"`
+
+	// URL is the webhook or ntfy topic URL; Headers are sent with every request
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// Token is the ntfy or Matrix access token
+	Token string `json:"token"`
+
+	// Homeserver and Room address a Matrix room
+	Homeserver string `json:"homeserver"`
+	Room       string `json:"room"`
+
+	// Host, Port and the credentials configure SMTP; mail goes from From to To
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+
+	// Path is the file sink's output file
+	Path string `json:"path"`
+}
+
+// sink is a publisher with the filter and format of its config.
+type sink struct {
+	Publisher
+	filter string
+}
+
+// PublishGroup fans posts out to every configured sink. A failing sink is
+// logged and does not keep the others from publishing.
+type PublishGroup struct {
+	sinks   []sink
+	timeout time.Duration
+}
+
+// loadPublishers reads SINKS_FILE. Without it posts go to SEND_TO_CHANNEL as before.
+func loadPublishers(threatMap *ThreatMap, templates *OutputTemplates) (*PublishGroup, error) {
+	group := &PublishGroup{timeout: envDuration("PUBLISH_TIMEOUT", 30*time.Second)}
+
+	live := loadLiveStatusStore()
+
+	path := getEnv("SINKS_FILE", defaultSinksFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		telegram := &TelegramSink{Channel: sendToChannel, Map: threatMap, postFormat: postFormat{format: sinkFormatText, templates: templates}}
+		if getEnv("LIVE_STATUS", "false") == "true" {
+			telegram.Live = live
+		}
+		group.sinks = []sink{{Publisher: telegram, filter: sinkFilterAll}}
+		return group, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading sinks file: %v", err)
+	}
+
+	var configs []SinkConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("error parsing sinks file %s: %v", path, err)
+	}
+	for i, sinkConfig := range configs {
+		publisher, err := newPublisher(sinkConfig, threatMap, live, templates)
+		if err != nil {
+			return nil, fmt.Errorf("sink %d in %s: %v", i+1, path, err)
+		}
+		filter := strings.ToLower(sinkConfig.Filter)
+		switch filter {
+		case "":
+			filter = sinkFilterAll
+		case sinkFilterAll, sinkFilterDanger:
+		default:
+			return nil, fmt.Errorf("sink %s has unknown filter %q", publisher.Name(), sinkConfig.Filter)
+		}
+		group.sinks = append(group.sinks, sink{Publisher: publisher, filter: filter})
+		log.Printf("Output sink: %s (%s)", publisher.Name(), filter)
+	}
+	if len(group.sinks) == 0 {
+		return nil, fmt.Errorf("sinks file %s lists no sinks", path)
+	}
+	return group, nil
+}
+
+func newPublisher(c SinkConfig, threatMap *ThreatMap, live *LiveStatusStore, templates *OutputTemplates) (Publisher, error) {
+	format := strings.ToLower(c.Format)
+	switch format {
+	case "":
+		format = sinkFormatText
+	case sinkFormatText, sinkFormatPlain, sinkFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown format %q", c.Format)
+	}
+
+	name := func(target string) string {
+		if c.Name != "" {
+			return c.Name
+		}
+		return c.Type + ":" + target
+	}
+	client := &http.Client{}
+	pf := postFormat{format: format, template: c.Template, templates: templates}
+
+	switch strings.ToLower(c.Type) {
+	case "telegram":
+		if c.Channel == "" {
+			return nil, fmt.Errorf("telegram sink needs a channel")
+		}
+		sink := &TelegramSink{name: name(c.Channel), Channel: c.Channel, postFormat: pf}
+		if c.Map == nil || *c.Map {
+			sink.Map = threatMap
+		}
+		if c.Live {
+			sink.Live = live
+		}
+		return sink, nil
+	case "webhook":
+		if c.URL == "" {
+			return nil, fmt.Errorf("webhook sink needs a url")
+		}
+		return &WebhookSink{name: name(c.URL), URL: c.URL, Headers: c.Headers, postFormat: pf, client: client}, nil
+	case "ntfy":
+		if c.URL == "" {
+			return nil, fmt.Errorf("ntfy sink needs a topic url")
+		}
+		return &NtfySink{name: name(c.URL), URL: c.URL, Token: c.Token, postFormat: pf, client: client}, nil
+	case "matrix":
+		if c.Homeserver == "" || c.Room == "" || c.Token == "" {
+			return nil, fmt.Errorf("matrix sink needs a homeserver, room and token")
+		}
+		return &MatrixSink{name: name(c.Room), Homeserver: strings.TrimRight(c.Homeserver, "/"), Room: c.Room, Token: c.Token, postFormat: pf, client: client}, nil
+	case "smtp":
+		if c.Host == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("smtp sink needs a host, from and to")
+		}
+		if c.Port == 0 {
+			c.Port = 587
+		}
+		return &SMTPSink{name: name(strings.Join(c.To, ",")), Host: c.Host, Port: c.Port, Username: c.Username, Password: c.Password, From: c.From, To: c.To, postFormat: pf}, nil
+	case "file":
+		if c.Path == "" {
+			return nil, fmt.Errorf("file sink needs a path")
+		}
+		if c.Format == "" {
+			pf.format = sinkFormatJSON
+		}
+		return &FileSink{name: name(c.Path), Path: c.Path, postFormat: pf}, nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", c.Type)
+	}
+}
+
+// BindTelegram gives the Telegram sinks the API client once the session is authenticated.
+func (g *PublishGroup) BindTelegram(api *tg.Client) {
+	if g == nil {
+		return
+	}
+	for _, s := range g.sinks {
+		if telegram, ok := s.Publisher.(*TelegramSink); ok {
+			telegram.api = api
+		}
+	}
+}
+
+// Publish sends the post to every sink whose filter accepts it, in parallel. It
+// returns the sinks that published and the joined errors of those that failed.
+func (g *PublishGroup) Publish(ctx context.Context, post Post) ([]string, error) {
+	if g == nil {
+		return nil, nil
+	}
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		published []string
+		errs      []error
+	)
+	for _, s := range g.sinks {
+		if s.filter == sinkFilterDanger && !post.Danger {
+			continue
+		}
+		wg.Add(1)
+		go func(s sink) {
+			defer wg.Done()
+			sinkCtx, cancel := context.WithTimeout(ctx, g.timeout)
+			defer cancel()
+			err := s.Publish(sinkCtx, post)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("Error publishing to %s: %v", s.Name(), err)
+				errs = append(errs, fmt.Errorf("%s: %w", s.Name(), err))
+				return
+			}
+			published = append(published, s.Name())
+		}(s)
+	}
+	wg.Wait()
+	return published, errors.Join(errs...)
+}
+
+// postFormat is how a sink renders posts: the format, and for the text format
+// the output template when one exists.
+type postFormat struct {
+	format    string
+	template  string
+	templates *OutputTemplates
+}
+
+func (f postFormat) render(post Post) FormattedText {
+	if f.format == sinkFormatText {
+		if formatted, ok := f.templates.Render(f.template, post); ok {
+			return formatted
+		}
+	}
+	return FormattedText{Text: renderPost(post, f.format)}
+}
+
+// renderPost formats the post for a sink.
+func renderPost(post Post, format string) string {
+	switch format {
+	case sinkFormatPlain:
+		return post.Response.Text
+	case sinkFormatJSON:
+		data, err := json.Marshal(post)
+		if err != nil {
+			return post.Text
+		}
+		return string(data)
+	default:
+		return post.Text
+	}
+}
+
+// postTitle is the subject line of notifications and mails.
+func postTitle(post Post) string {
+	if post.Danger {
+		return "🚨 Небезпека"
+	}
+	return "✅ Оновлення статусу"
+}
+
+// sendHTTP sends a request and fails on non-2xx responses.
+func sendHTTP(ctx context.Context, client *http.Client, method, endpoint, contentType string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// TelegramSink posts to a Telegram channel or group, with the threat map when
+// Map is set. With Live set it keeps one pinned message up to date instead.
+type TelegramSink struct {
+	Channel string
+	Map     *ThreatMap
+	Live    *LiveStatusStore
+
+	name string
+	postFormat
+	api *tg.Client
+}
+
+func (s *TelegramSink) Name() string {
+	if s.name == "" {
+		return "telegram:" + s.Channel
+	}
+	return s.name
+}
+
+func (s *TelegramSink) Publish(ctx context.Context, post Post) error {
+	if s.api == nil {
+		return fmt.Errorf("telegram client not ready")
+	}
+	if s.Live != nil {
+		return s.publishLive(ctx, post)
+	}
+	return sendResponse(ctx, s.api, s.Channel, s.Map, post.Response, s.render(post))
+}
+
+// WebhookSink POSTs the post as JSON, with Text rendered in the sink's format.
+type WebhookSink struct {
+	URL     string
+	Headers map[string]string
+
+	name string
+	postFormat
+	client *http.Client
+}
+
+func (s *WebhookSink) Name() string { return s.name }
+
+func (s *WebhookSink) Publish(ctx context.Context, post Post) error {
+	if s.format != sinkFormatJSON {
+		post.Text = s.render(post).Text
+	}
+	body, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+	return sendHTTP(ctx, s.client, http.MethodPost, s.URL, "application/json", s.Headers, body)
+}
+
+// NtfySink pushes to an ntfy topic; danger posts get urgent priority.
+type NtfySink struct {
+	URL   string
+	Token string
+
+	name string
+	postFormat
+	client *http.Client
+}
+
+func (s *NtfySink) Name() string { return s.name }
+
+func (s *NtfySink) Publish(ctx context.Context, post Post) error {
+	headers := map[string]string{
+		// ntfy reads non-ASCII titles RFC 2047 encoded
+		"Title":    mime.QEncoding.Encode("utf-8", postTitle(post)),
+		"Priority": "default",
+	}
+	if post.Danger {
+		headers["Priority"] = "urgent"
+		headers["Tags"] = "rotating_light"
+	}
+	if s.Token != "" {
+		headers["Authorization"] = "Bearer " + s.Token
+	}
+	return sendHTTP(ctx, s.client, http.MethodPost, s.URL, "text/plain; charset=utf-8", headers, []byte(s.render(post).Text))
+}
+
+// MatrixSink sends an m.text message to a Matrix room through the client-server API.
+type MatrixSink struct {
+	Homeserver string
+	Room       string
+	Token      string
+
+	name string
+	postFormat
+	client *http.Client
+}
+
+func (s *MatrixSink) Name() string { return s.name }
+
+func (s *MatrixSink) Publish(ctx context.Context, post Post) error {
+	body, err := json.Marshal(map[string]string{"msgtype": "m.text", "body": s.render(post).Text})
+	if err != nil {
+		return err
+	}
+	// The transaction ID makes a retried request idempotent
+	txnID := strconv.FormatInt(post.Time.UnixNano(), 10)
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", s.Homeserver, url.PathEscape(s.Room), txnID)
+	return sendHTTP(ctx, s.client, http.MethodPut, endpoint, "application/json", map[string]string{"Authorization": "Bearer " + s.Token}, body)
+}
+
+// SMTPSink mails every post. net/smtp upgrades to STARTTLS when the server offers it.
+type SMTPSink struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	To       []string
+
+	name string
+	postFormat
+}
+
+func (s *SMTPSink) Name() string { return s.name }
+
+func (s *SMTPSink) Publish(ctx context.Context, post Post) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", postTitle(post)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", post.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(s.render(post).Text, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	// smtp.SendMail takes no context, run it aside so the sink timeout still applies
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(fmt.Sprintf("%s:%d", s.Host, s.Port), auth, s.From, s.To, []byte(msg.String()))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FileSink appends posts to a local file, one per line in JSON format.
+type FileSink struct {
+	Path string
+
+	name string
+	postFormat
+	mu sync.Mutex
+}
+
+func (s *FileSink) Name() string { return s.name }
+
+func (s *FileSink) Publish(ctx context.Context, post Post) error {
+	entry := s.render(post).Text
+	if s.format != sinkFormatJSON {
+		entry = post.Time.Format(time.RFC3339) + " " + strings.ReplaceAll(entry, "\n", " ")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(entry + "\n")
+	return err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// publishSuppressed counts posts held back by the publish guard, keyed by reason.
+var publishSuppressed = expvar.NewMap("publish_suppressed")
+
+// PublishGuardPolicy limits how often posts go out. The rate limit is a token
+// bucket: Burst posts may go out back to back, then one per MinInterval.
+type PublishGuardPolicy struct {
+	MinInterval time.Duration
+	Burst       int
+	// DuplicateHistory is how many published posts new ones are compared with;
+	// a post at least DuplicateSimilarity similar to one of them is suppressed
+	DuplicateHistory    int
+	DuplicateSimilarity float64
+	// DangerBypass lets escalations, danger turning true, skip the guard
+	DangerBypass bool
+}
+
+func loadPublishGuardPolicy() PublishGuardPolicy {
+	policy := PublishGuardPolicy{
+		MinInterval:         envDuration("PUBLISH_MIN_INTERVAL", time.Minute),
+		Burst:               envInt("PUBLISH_BURST", 2),
+		DuplicateHistory:    envInt("PUBLISH_DUPLICATE_HISTORY", 5),
+		DuplicateSimilarity: envFloat("PUBLISH_DUPLICATE_SIMILARITY", 0.8),
+		DangerBypass:        getEnv("PUBLISH_DANGER_BYPASS", "true") == "true",
+	}
+	if policy.Burst < 1 {
+		log.Printf("Invalid PUBLISH_BURST %d, using 1", policy.Burst)
+		policy.Burst = 1
+	}
+	if policy.DuplicateHistory < 0 {
+		policy.DuplicateHistory = 0
+	}
+	return policy
+}
+
+// Guard reasons. Duplicates are dropped, rate limited posts wait for a token.
+const (
+	guardDuplicate = "duplicate"
+	guardRate      = "rate"
+)
+
+// publishedPost is a post the guard compares new ones with.
+type publishedPost struct {
+	Shingles []uint64
+	Danger   bool
+}
+
+// deferredPost is a rate limited post waiting for a token.
+type deferredPost struct {
+	post    Post
+	publish func(Post)
+}
+
+// PublishGuard decides whether a post may go out. Check is called before a
+// post is published or queued for review, Record once it was published.
+type PublishGuard struct {
+	policy PublishGuardPolicy
+
+	mu         sync.Mutex
+	tokens     float64
+	refilled   time.Time
+	recent     []publishedPost
+	lastDanger bool
+	// deferred is the latest rate limited post; timer publishes it once a token
+	// is free and releasing is set while it is being published
+	deferred  *deferredPost
+	timer     *time.Timer
+	releasing bool
+}
+
+func newPublishGuard(policy PublishGuardPolicy) *PublishGuard {
+	return &PublishGuard{policy: policy, tokens: float64(policy.Burst), refilled: time.Now()}
+}
+
+// refill adds the tokens earned since the last refill. Callers hold mu.
+func (g *PublishGuard) refill(now time.Time) {
+	if g.policy.MinInterval <= 0 {
+		g.tokens = float64(g.policy.Burst)
+		return
+	}
+	g.tokens += float64(now.Sub(g.refilled)) / float64(g.policy.MinInterval)
+	g.tokens = min(g.tokens, float64(g.policy.Burst))
+	g.refilled = now
+}
+
+// Check returns why the post must not be published now, or "" to publish it.
+// A rate limited post should be handed to Defer. Every new post supersedes a
+// deferred one, which would only publish an outdated status.
+func (g *PublishGuard) Check(post Post) string {
+	if g == nil {
+		return ""
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.deferred != nil {
+		g.deferred = nil
+		publishSuppressed.Add("superseded", 1)
+		log.Printf("Publish guard dropped the deferred post, a newer one superseded it")
+	}
+	reason := g.check(post)
+	switch reason {
+	case "":
+	case guardRate:
+		publishSuppressed.Add(reason, 1)
+		log.Printf("Publish guard deferred post until the rate limit allows it: %.80q", post.Response.Text)
+	default:
+		publishSuppressed.Add(reason, 1)
+		log.Printf("Publish guard suppressed post (%s): %.80q", reason, post.Response.Text)
+	}
+	return reason
+}
+
+// bypasses reports whether the post is an escalation that skips the guard. Callers hold mu.
+func (g *PublishGuard) bypasses(post Post) bool {
+	return post.Danger && !g.lastDanger && g.policy.DangerBypass
+}
+
+func (g *PublishGuard) check(post Post) string {
+	bypass := g.bypasses(post)
+	if !bypass {
+		shingles := textShingles(post.Response.Text)
+		for _, recent := range g.recent {
+			if recent.Danger == post.Danger && shingleSimilarity(recent.Shingles, shingles) >= g.policy.DuplicateSimilarity {
+				return guardDuplicate
+			}
+		}
+	}
+
+	// A deferred post is being published, wait for it so posts go out in order
+	if g.releasing {
+		return guardRate
+	}
+	if bypass {
+		return ""
+	}
+	g.refill(time.Now())
+	if g.tokens < 1 {
+		return guardRate
+	}
+	return ""
+}
+
+// Defer holds a rate limited post and calls publish once a token is free,
+// unless a newer post supersedes it first.
+func (g *PublishGuard) Defer(post Post, publish func(Post)) {
+	if g == nil {
+		publish(post)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.deferred = &deferredPost{post: post, publish: publish}
+	g.schedule()
+}
+
+// schedule starts the timer releasing the deferred post. Callers hold mu.
+func (g *PublishGuard) schedule() {
+	if g.deferred == nil || g.releasing || g.timer != nil {
+		return
+	}
+	var wait time.Duration
+	if !g.bypasses(g.deferred.post) {
+		g.refill(time.Now())
+		wait = time.Duration((1 - g.tokens) * float64(g.policy.MinInterval))
+	}
+	g.timer = time.AfterFunc(max(wait, 0), g.release)
+}
+
+// release publishes the deferred post once a token is free.
+func (g *PublishGuard) release() {
+	g.mu.Lock()
+	g.timer = nil
+	deferred := g.deferred
+	if deferred == nil {
+		g.mu.Unlock()
+		return
+	}
+	g.refill(time.Now())
+	if g.tokens < 1 && !g.bypasses(deferred.post) {
+		// An escalation took the token meanwhile
+		g.schedule()
+		g.mu.Unlock()
+		return
+	}
+	g.deferred = nil
+	g.releasing = true
+	g.mu.Unlock()
+
+	log.Printf("Publishing deferred post: %.80q", deferred.post.Response.Text)
+	deferred.publish(deferred.post)
+
+	g.mu.Lock()
+	g.releasing = false
+	g.schedule()
+	g.mu.Unlock()
+}
+
+// Record counts a published post against the rate limit and keeps it for the
+// duplicate check.
+func (g *PublishGuard) Record(post Post) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.refill(time.Now())
+	// Bypassing escalations may overdraw the bucket, the posts after them wait longer
+	g.tokens--
+	g.lastDanger = post.Danger
+	g.recent = append(g.recent, publishedPost{Shingles: textShingles(post.Response.Text), Danger: post.Danger})
+	if len(g.recent) > g.policy.DuplicateHistory {
+		g.recent = g.recent[len(g.recent)-g.policy.DuplicateHistory:]
+	}
+}
+
+// String describes the policy for the startup log.
+func (p PublishGuardPolicy) String() string {
+	return fmt.Sprintf("min interval %v, burst %d, duplicates among last %d at %.2f similarity, danger bypass %v",
+		p.MinInterval, p.Burst, p.DuplicateHistory, p.DuplicateSimilarity, p.DangerBypass)
+}
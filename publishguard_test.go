@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func guardPost(text string, danger bool) Post {
+	return Post{Danger: danger, Text: text, Response: AIJSONResponse{Text: text, Danger: danger, StatusChanged: true}}
+}
+
+func TestPublishGuardCheck(t *testing.T) {
+	policy := PublishGuardPolicy{MinInterval: time.Hour, Burst: 2, DuplicateHistory: 5, DuplicateSimilarity: 0.8, DangerBypass: true}
+	steps := []struct {
+		post Post
+		want string
+	}{
+		{guardPost("Загроза балістики для Одеси", true), ""},
+		{guardPost("Шахеди над Затокою, курс на північ", true), ""},
+		// The bucket is empty now
+		{guardPost("Шахеди над Овідіополем, курс на Одесу", true), guardRate},
+		{guardPost("Загроза балістики для Одеси", true), guardDuplicate},
+	}
+
+	guard := newPublishGuard(policy)
+	for i, step := range steps {
+		got := guard.Check(step.post)
+		if got != step.want {
+			t.Fatalf("step %d: Check = %q, want %q", i, got, step.want)
+		}
+		if got == "" {
+			guard.Record(step.post)
+		}
+	}
+
+	// Escalations skip the guard even with an empty bucket
+	guard.Record(guardPost("Відбій тривоги", false))
+	if got := guard.Check(guardPost("Нова загроза шахедів з моря", true)); got != "" {
+		t.Fatalf("escalation: Check = %q, want it to bypass the guard", got)
+	}
+}
+
+func TestPublishGuardDefer(t *testing.T) {
+	guard := newPublishGuard(PublishGuardPolicy{MinInterval: 50 * time.Millisecond, Burst: 1, DuplicateSimilarity: 0.8})
+	first := guardPost("Шахеди над Затокою", true)
+	if reason := guard.Check(first); reason != "" {
+		t.Fatalf("first post: Check = %q", reason)
+	}
+	guard.Record(first)
+
+	var mu sync.Mutex
+	var published []string
+	done := make(chan struct{})
+	publish := func(post Post) {
+		mu.Lock()
+		published = append(published, post.Response.Text)
+		mu.Unlock()
+		guard.Record(post)
+		close(done)
+	}
+
+	// The newer rate limited post supersedes the older one
+	for _, text := range []string{"Шахеди над Овідіополем", "Відбій загрози"} {
+		post := guardPost(text, false)
+		if reason := guard.Check(post); reason != guardRate {
+			t.Fatalf("%s: Check = %q, want %q", text, reason, guardRate)
+		}
+		guard.Defer(post, publish)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deferred post was never published")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(published) != 1 || published[0] != "Відбій загрози" {
+		t.Fatalf("published %q, want only the latest post", published)
+	}
+}
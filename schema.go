@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// aiResponseSchemaName is the name under which the response schema is registered
+// with providers that require one (OpenAI json_schema, Anthropic tools).
+const aiResponseSchemaName = "situation_report"
+
+// aiResponseSchema returns the JSON Schema of AIJSONResponse. Properties are taken
+// from the json tags, descriptions from the desc tags.
+func aiResponseSchema() map[string]interface{} {
+	return jsonSchemaFor(reflect.TypeOf(AIJSONResponse{}))
+}
+
+// jsonSchemaFor builds a strict JSON Schema for a Go type. Struct fields become
+// required properties and additional properties are rejected, which is what
+// OpenAI strict mode and grammar-constrained decoding expect. Pointer fields are
+// nullable, and an enum tag restricts a string to a list from schemaEnums.
+func jsonSchemaFor(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		var required []string
+		for _, field := range schemaFields(t) {
+			property := jsonSchemaFor(field.Type)
+			if field.Description != "" {
+				property["description"] = field.Description
+			}
+			if values, ok := schemaEnums[field.Enum]; ok {
+				property["enum"] = values
+			}
+			properties[field.Name] = property
+			required = append(required, field.Name)
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"required":             required,
+			"additionalProperties": false,
+		}
+	case reflect.Ptr:
+		// Pointers are optional values: strict schemas require every property,
+		// so optional ones are expressed as nullable
+		schema := jsonSchemaFor(t.Elem())
+		schema["type"] = []string{schema["type"].(string), "null"}
+		return schema
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": jsonSchemaFor(t.Elem()),
+		}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+// schemaField describes a struct field as it appears in the JSON encoding.
+type schemaField struct {
+	Name        string
+	Description string
+	Enum        string
+	Type        reflect.Type
+}
+
+// schemaFields lists the exported, JSON-encoded fields of a struct in declaration order.
+func schemaFields(t reflect.Type) []schemaField {
+	var fields []schemaField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, schemaField{Name: name, Description: field.Tag.Get("desc"), Enum: field.Tag.Get("enum"), Type: field.Type})
+	}
+	return fields
+}
+
+// geminiSchema converts a JSON Schema into the OpenAPI subset accepted by
+// Gemini's responseSchema: upper-case types, nullable instead of type lists, no
+// additionalProperties, and an explicit propertyOrdering so the model emits
+// fields in a stable order.
+func geminiSchema(schema map[string]interface{}) map[string]interface{} {
+	converted := make(map[string]interface{})
+	for key, value := range schema {
+		switch key {
+		case "additionalProperties":
+			continue
+		case "type":
+			if types, ok := value.([]string); ok {
+				// ["integer", "null"] becomes INTEGER with nullable
+				converted[key] = strings.ToUpper(types[0])
+				converted["nullable"] = true
+				continue
+			}
+			converted[key] = strings.ToUpper(fmt.Sprint(value))
+		case "enum":
+			converted[key] = value
+			converted["format"] = "enum"
+		case "properties":
+			properties := make(map[string]interface{})
+			for name, property := range value.(map[string]interface{}) {
+				properties[name] = geminiSchema(property.(map[string]interface{}))
+			}
+			converted[key] = properties
+		case "items":
+			converted[key] = geminiSchema(value.(map[string]interface{}))
+		default:
+			converted[key] = value
+		}
+	}
+	if required, ok := schema["required"].([]string); ok {
+		converted["propertyOrdering"] = required
+	}
+	return converted
+}
+
+// gbnfGrammar renders a JSON Schema produced by jsonSchemaFor as a GBNF grammar,
+// the format llama.cpp uses to constrain local model output.
+func gbnfGrammar(schema map[string]interface{}) string {
+	g := &gbnfBuilder{rules: make(map[string]string)}
+	root := g.rule("root", schema)
+	g.rules["ws"] = `[ \t\n]*`
+	g.rules["string"] = `"\"" ( [^"\\\x00-\x1f] | "\\" ["\\/bfnrt] | "\\u" [0-9a-fA-F]{4} )* "\""`
+	g.rules["boolean"] = `"true" | "false"`
+	g.rules["integer"] = `"-"? [0-9]+`
+	g.rules["number"] = `"-"? [0-9]+ ("." [0-9]+)? ([eE] [-+]? [0-9]+)?`
+
+	names := make([]string, 0, len(g.rules))
+	for name := range g.rules {
+		if name != root {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "root ::= %s\n", g.rules[root])
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s ::= %s\n", name, g.rules[name])
+	}
+	return b.String()
+}
+
+type gbnfBuilder struct {
+	rules map[string]string
+}
+
+// rule registers the rule for a schema node and returns its name.
+func (g *gbnfBuilder) rule(name string, schema map[string]interface{}) string {
+	if types, ok := schema["type"].([]string); ok {
+		nonNull := make(map[string]interface{}, len(schema))
+		for key, value := range schema {
+			nonNull[key] = value
+		}
+		nonNull["type"] = types[0]
+		g.rules[name] = fmt.Sprintf(`%s | "null"`, g.rule(name+"-value", nonNull))
+		return name
+	}
+	if values, ok := schema["enum"].([]string); ok {
+		alternatives := make([]string, len(values))
+		for i, value := range values {
+			alternatives[i] = fmt.Sprintf(`"\"%s\""`, value)
+		}
+		g.rules[name] = strings.Join(alternatives, " | ")
+		return name
+	}
+	switch schema["type"] {
+	case "object":
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]string)
+		var parts []string
+		for i, property := range required {
+			sub := g.rule(name+"-"+property, properties[property].(map[string]interface{}))
+			sep := ""
+			if i > 0 {
+				sep = `"," ws `
+			}
+			parts = append(parts, fmt.Sprintf(`%s"\"%s\"" ws ":" ws %s`, sep, property, sub))
+		}
+		g.rules[name] = `"{" ws ` + strings.Join(parts, " ws ") + ` ws "}"`
+		return name
+	case "array":
+		item := g.rule(name+"-item", schema["items"].(map[string]interface{}))
+		g.rules[name] = fmt.Sprintf(`"[" ws ( %s ( ws "," ws %s )* )? ws "]"`, item, item)
+		return name
+	case "boolean", "integer", "number":
+		return schema["type"].(string)
+	default:
+		return "string"
+	}
+}
+
+// parseAIJSON extracts an AIJSONResponse from free-form model output. It is the
+// fallback for providers without native structured output and tolerates BOMs,
+// markdown code fences and prose around the JSON object.
+func parseAIJSON(text string) (AIJSONResponse, error) {
+	var aiResp AIJSONResponse
+	object, err := extractJSONObject(text)
+	if err != nil {
+		return aiResp, err
+	}
+	if err := json.Unmarshal([]byte(object), &aiResp); err != nil {
+		return aiResp, fmt.Errorf("failed to unmarshal AI response: %w (content: %q)", err, object)
+	}
+	return aiResp, nil
+}
+
+// extractJSONObject returns the first balanced top-level JSON object in text.
+func extractJSONObject(text string) (string, error) {
+	text = strings.TrimPrefix(strings.TrimSpace(text), "\ufeff")
+	start := strings.IndexByte(text, '{')
+	if start < 0 {
+		return "", fmt.Errorf("no JSON object found in AI response: %q", text)
+	}
+
+	depth := 0
+	inString, escaped := false, false
+	for i := start; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return text[start : i+1], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unterminated JSON object in AI response: %q", text[start:])
+}
+
+// schemaInstruction describes the response schema in the prompt for providers
+// that only offer a generic JSON mode.
+func schemaInstruction() string {
+	schema, err := json.Marshal(aiResponseSchema())
+	if err != nil {
+		return ""
+	}
+	return "Respond with a single JSON object matching this JSON Schema: " + string(schema)
+}
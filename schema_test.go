@@ -0,0 +1,125 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExtractJSONObject(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{"plain", `{"text":"a"}`, `{"text":"a"}`, false},
+		{"byte order mark", "\ufeff{\"text\":\"a\"}", `{"text":"a"}`, false},
+		{"markdown fence", "```json\n{\"text\":\"a\"}\n```", `{"text":"a"}`, false},
+		{"chatty prose", "Here is the report: {\"text\":\"a\"} Hope it helps!", `{"text":"a"}`, false},
+		{"nested objects", `{"a":{"b":{}},"c":1} trailing {}`, `{"a":{"b":{}},"c":1}`, false},
+		{"braces in strings", `{"text":"} and { \" inside"}`, `{"text":"} and { \" inside"}`, false},
+		{"no object", "no JSON here", "", true},
+		{"unterminated", `{"text":"a"`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractJSONObject(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAIJSON(t *testing.T) {
+	resp, err := parseAIJSON("```json\n{\"text\":\"Шахеди\",\"danger\":true,\"statusChanged\":true,\"confidence\":0.8}\n```")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "Шахеди" || !resp.Danger || !resp.StatusChanged || resp.Confidence == nil || *resp.Confidence != 0.8 {
+		t.Fatalf("parsed %+v", resp)
+	}
+	if _, err := parseAIJSON(`{"danger":"yes"}`); err == nil {
+		t.Fatal("wrong field types must fail")
+	}
+}
+
+func TestAIResponseSchema(t *testing.T) {
+	schema := aiResponseSchema()
+	required, _ := schema["required"].([]string)
+	for _, field := range []string{"text", "principle", "danger", "statusChanged", "threats", "confidence", "sources"} {
+		if !slices.Contains(required, field) {
+			t.Errorf("field %s is not required", field)
+		}
+	}
+	if schema["additionalProperties"] != false {
+		t.Error("strict schemas must reject additional properties")
+	}
+	properties := schema["properties"].(map[string]interface{})
+	confidence := properties["confidence"].(map[string]interface{})
+	if types, ok := confidence["type"].([]string); !ok || !slices.Equal(types, []string{"number", "null"}) {
+		t.Errorf("confidence type = %v, want nullable number", confidence["type"])
+	}
+	if properties["text"].(map[string]interface{})["description"] == "" {
+		t.Error("desc tags must become descriptions")
+	}
+}
+
+func TestGeminiSchema(t *testing.T) {
+	schema := geminiSchema(aiResponseSchema())
+	if schema["type"] != "OBJECT" {
+		t.Fatalf("type = %v, want OBJECT", schema["type"])
+	}
+	if _, ok := schema["additionalProperties"]; ok {
+		t.Fatal("Gemini rejects additionalProperties")
+	}
+	if ordering, ok := schema["propertyOrdering"].([]string); !ok || ordering[0] != "text" {
+		t.Fatalf("propertyOrdering = %v", schema["propertyOrdering"])
+	}
+	confidence := schema["properties"].(map[string]interface{})["confidence"].(map[string]interface{})
+	if confidence["type"] != "NUMBER" || confidence["nullable"] != true {
+		t.Fatalf("confidence = %v, want nullable NUMBER", confidence)
+	}
+}
+
+// gbnfReference matches rule names used in a rule body, outside quoted literals
+// and character classes.
+var gbnfReference = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9-]*`)
+
+func TestGBNFGrammar(t *testing.T) {
+	grammar := gbnfGrammar(aiResponseSchema())
+	rules := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(grammar), "\n") {
+		name, body, ok := strings.Cut(line, " ::= ")
+		if !ok {
+			t.Fatalf("malformed rule %q", line)
+		}
+		if _, dup := rules[name]; dup {
+			t.Fatalf("rule %s defined twice", name)
+		}
+		rules[name] = body
+	}
+	if !strings.HasPrefix(grammar, "root ::= ") {
+		t.Fatal("the grammar must start with the root rule")
+	}
+
+	literals := regexp.MustCompile(`"(?:[^"\\]|\\.)*"|\[(?:[^\]\\]|\\.)*\]|\{[0-9,]+\}`)
+	for name, body := range rules {
+		for _, reference := range gbnfReference.FindAllString(literals.ReplaceAllString(body, " "), -1) {
+			if _, ok := rules[reference]; !ok {
+				t.Errorf("rule %s references undefined rule %s", name, reference)
+			}
+		}
+	}
+
+	for _, want := range []string{`"\"statusChanged\""`, `"\"shahed\""`, `| "null"`} {
+		if !strings.Contains(grammar, want) {
+			t.Errorf("grammar lacks %s", want)
+		}
+	}
+}
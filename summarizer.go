@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// summarySystemMessage instructs the summarizer model. The answer still uses the
+// AIJSONResponse schema; only its text field is used.
+const summarySystemMessage = `You maintain a running situation summary for an air-raid monitoring bot in Odesa.
+You receive the previous summary and older messages that are being removed from the conversation.
+Merge them into one updated summary: threats seen (type, count, direction, time), areas mentioned,
+what was already published, and whether the threat is still active. Drop chatter and duplicates,
+keep times. Write at most 8 short lines in the language of the messages.
+Put the summary into the "text" field; set danger to true only if the summary describes an active threat
+and statusChanged to false.`
+
+// aiSummarizer implements HistorySummarizer using an AI provider, which can be a
+// cheaper model than the one making the danger calls.
+type aiSummarizer struct {
+	config Config
+	choice string
+}
+
+// newHistorySummarizer returns the summarizer selected by AI_SUMMARY_CHOICE, or nil
+// when summarization is disabled. "same" uses the main provider (the ensemble primary
+// for ensembles).
+func newHistorySummarizer(config Config) (HistorySummarizer, error) {
+	choice := strings.ToLower(getEnv("AI_SUMMARY_CHOICE", ""))
+	switch choice {
+	case "":
+		return nil, nil
+	case "same":
+		choice = strings.ToLower(config.AIChoice)
+		if choice == "ensemble" {
+			choice = strings.ToLower(config.EnsemblePrimary)
+			if choice == "" && len(config.EnsembleProviders) > 0 {
+				choice = strings.ToLower(config.EnsembleProviders[0])
+			}
+		}
+	case "ensemble":
+		return nil, fmt.Errorf("the summarizer cannot be an ensemble")
+	}
+
+	// Validate the choice up front instead of failing on the first eviction
+	if _, err := newAIClient(config, choice, summarySystemMessage); err != nil {
+		return nil, err
+	}
+	log.Printf("History summarization enabled using %s", choice)
+	return &aiSummarizer{config: config, choice: choice}, nil
+}
+
+// Summarize asks the summarizer model to merge the evicted messages into the previous summary.
+// A fresh client is used for every call so the summarizer keeps no history of its own.
+func (s *aiSummarizer) Summarize(ctx context.Context, previous string, evicted []Message) (string, error) {
+	client, err := newAIClient(s.config, s.choice, summarySystemMessage)
+	if err != nil {
+		return "", err
+	}
+
+	var request strings.Builder
+	if previous != "" {
+		request.WriteString("Previous summary:\n")
+		request.WriteString(previous)
+		request.WriteString("\n\n")
+	}
+	request.WriteString("Messages being removed:\n")
+	for _, msg := range evicted {
+		fmt.Fprintf(&request, "[%s] %s\n", msg.Role, formatMessageForLog(msg))
+	}
+
+	resp, err := client.SendMessage(ctx, Message{Role: "user", Content: request.String()})
+	if err != nil {
+		return "", err
+	}
+	summary := strings.TrimSpace(resp.Text)
+	if summary == "" {
+		return "", fmt.Errorf("summarizer returned an empty summary")
+	}
+	return summary, nil
+}
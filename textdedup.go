@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// textShingleSize is the number of characters per shingle. Character shingles
+// hold up better than word shingles on short posts with emoji and signatures.
+const textShingleSize = 4
+
+// MessageSource identifies a channel post a message was built from.
+type MessageSource struct {
+	Channel   string `json:"channel"`
+	MessageID int    `json:"messageId"`
+}
+
+// TextDedupPolicy configures near-duplicate detection of message text.
+type TextDedupPolicy struct {
+	// Window is how long texts are remembered, 0 disables deduplication
+	Window time.Duration
+	// Similarity is the Jaccard similarity of the shingle sets at which texts are the same
+	Similarity float64
+	// MinLength skips short texts such as "Тихо", which channels write independently
+	MinLength int
+}
+
+func loadTextDedupPolicy() TextDedupPolicy {
+	return TextDedupPolicy{
+		Window:     envDuration("AI_TEXT_DEDUP_WINDOW", 10*time.Minute),
+		Similarity: envFloat("AI_TEXT_DEDUP_SIMILARITY", 0.7),
+		MinLength:  envInt("AI_TEXT_DEDUP_MIN_LENGTH", 40),
+	}
+}
+
+// textShingles fingerprints text as the sorted hashes of its character shingles.
+// The text is lowercased and reduced to letters and digits first, so emoji,
+// punctuation and line breaks do not matter.
+func textShingles(text string) []uint64 {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	runes := []rune(strings.Join(words, " "))
+	if len(runes) < textShingleSize {
+		return nil
+	}
+
+	seen := make(map[uint64]bool)
+	var shingles []uint64
+	for i := 0; i+textShingleSize <= len(runes); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(string(runes[i : i+textShingleSize])))
+		if sum := h.Sum64(); !seen[sum] {
+			seen[sum] = true
+			shingles = append(shingles, sum)
+		}
+	}
+	slices.Sort(shingles)
+	return shingles
+}
+
+// shingleSimilarity is the Jaccard similarity of two sorted shingle sets.
+func shingleSimilarity(a, b []uint64) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] == b[j]:
+			shared++
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// textDedupEntry is a text seen recently.
+type textDedupEntry struct {
+	shingles []uint64
+	channel  string
+	seen     time.Time
+}
+
+// TextDedupCache remembers recent message texts so copies posted by other
+// channels can be collapsed into the original.
+type TextDedupCache struct {
+	Policy TextDedupPolicy
+
+	mu      sync.Mutex
+	entries []textDedupEntry
+}
+
+func newTextDedupCache(policy TextDedupPolicy) *TextDedupCache {
+	return &TextDedupCache{Policy: policy}
+}
+
+// Fingerprint returns the shingles of a cleaned message text, or nil when the
+// text is too short to be deduplicated or deduplication is disabled.
+func (c *TextDedupCache) Fingerprint(text string) []uint64 {
+	if c == nil || c.Policy.Window <= 0 || utf8.RuneCountInString(text) < c.Policy.MinLength {
+		return nil
+	}
+	return textShingles(text)
+}
+
+// Check returns the channel that first posted a near-identical text within the
+// window. New texts are remembered and reported as not duplicate. An empty
+// fingerprint is never a duplicate.
+func (c *TextDedupCache) Check(shingles []uint64, channel string) (string, bool) {
+	if c == nil || len(shingles) == 0 {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	kept := c.entries[:0]
+	for _, entry := range c.entries {
+		if now.Sub(entry.seen) <= c.Policy.Window {
+			kept = append(kept, entry)
+		}
+	}
+	c.entries = kept
+
+	for _, entry := range c.entries {
+		if similarity := shingleSimilarity(shingles, entry.shingles); similarity >= c.Policy.Similarity {
+			log.Printf("Text from %s repeats text from %s (similarity %.2f)", channel, entry.channel, similarity)
+			return entry.channel, true
+		}
+	}
+	c.entries = append(c.entries, textDedupEntry{shingles: shingles, channel: channel, seen: now})
+	return "", false
+}
+
+// collapseRepost adds msg to the buffer unless it repeats a recent text. A repeat
+// of a buffered message only adds its source to that message; a repeat of a text
+// already sent to the AI is reduced to a one-line note so it is not counted twice.
+func collapseRepost(buffer []Message, msg Message, cache *TextDedupCache) []Message {
+	source := msg.Sources[0]
+	original, dup := cache.Check(msg.Shingles, source.Channel)
+	if !dup {
+		return append(buffer, msg)
+	}
+
+	for i := range buffer {
+		if buffer[i].Sources[0].Channel == original && shingleSimilarity(buffer[i].Shingles, msg.Shingles) >= cache.Policy.Similarity {
+			buffer[i].Sources = append(buffer[i].Sources, source)
+			// Images of the copy are kept, the image deduplication already dropped identical ones
+			buffer[i].Images = append(buffer[i].Images, msg.Images...)
+			return buffer
+		}
+	}
+
+	msg.Content = fmt.Sprintf("[repost of an earlier message from %s]", original)
+	return append(buffer, msg)
+}
+
+// sourceHeader introduces a buffered message in the prompt, naming every channel
+// that carried it so the model can weigh the number of independent sources.
+func sourceHeader(msg Message) string {
+	if len(msg.Sources) == 0 {
+		return ""
+	}
+	if len(msg.Sources) == 1 {
+		return fmt.Sprintf("Message from %s:\n", msg.Sources[0].Channel)
+	}
+	channels := make([]string, len(msg.Sources))
+	for i, source := range msg.Sources {
+		channels[i] = source.Channel
+	}
+	return fmt.Sprintf("Message from %s (same text in %d channels: %s):\n",
+		msg.Sources[0].Channel, len(msg.Sources), strings.Join(channels, ", "))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShingleSimilarity(t *testing.T) {
+	const post = "Група шахедів над Затокою, рухаються в напрямку Одеси. Будьте в укриттях!"
+	tests := []struct {
+		name string
+		a, b string
+		min  float64
+		max  float64
+	}{
+		{"identical", post, post, 1, 1},
+		{"emoji, case and punctuation", post, "🚨 ГРУПА шахедів над Затокою — рухаються в напрямку Одеси!!! Будьте в укриттях", 1, 1},
+		{"repost with a signature", post, post + " Підписатися: @odesa_news", 0.7, 0.99},
+		{"unrelated", post, "Відбій тривоги в Одеській області, гарного вечора", 0, 0.1},
+		{"too short", post, "Тих", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shingleSimilarity(textShingles(tt.a), textShingles(tt.b))
+			if got < tt.min || got > tt.max {
+				t.Fatalf("similarity = %.2f, want between %.2f and %.2f", got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestTextShingles(t *testing.T) {
+	if shingles := textShingles("!!! 🚨"); shingles != nil {
+		t.Fatalf("text without letters gave %d shingles", len(shingles))
+	}
+	// Repeated shingles are counted once
+	if shingles := textShingles("абвабвабв"); len(shingles) != 3 {
+		t.Fatalf("got %d shingles, want 3", len(shingles))
+	}
+}
+
+func TestTextDedupCache(t *testing.T) {
+	cache := newTextDedupCache(TextDedupPolicy{Window: time.Minute, Similarity: 0.7, MinLength: 20})
+	const post = "Група шахедів над Затокою, рухаються в напрямку Одеси"
+
+	if shingles := cache.Fingerprint("Тихо"); shingles != nil {
+		t.Fatal("short texts must not be fingerprinted")
+	}
+	if _, dup := cache.Check(cache.Fingerprint(post), "@first"); dup {
+		t.Fatal("first text reported as duplicate")
+	}
+	if original, dup := cache.Check(cache.Fingerprint("🚨 "+post+"!"), "@second"); !dup || original != "@first" {
+		t.Fatalf("Check = %q, %v, want @first, true", original, dup)
+	}
+
+	var disabled *TextDedupCache
+	if _, dup := disabled.Check(textShingles(post), "@first"); dup {
+		t.Fatal("a nil cache must not report duplicates")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"math/rand"
+	"slices"
+
+	"github.com/gotd/td/telegram/uploader"
+	"github.com/gotd/td/tg"
+)
+
+// baseMapData is a schematic Odesa region coastline, drawn once at startup.
+//
+//go:embed data/basemap.json
+var baseMapData []byte
+
+// telegramCaptionLimit is the longest photo caption Telegram accepts, in UTF-16
+// code units of the text without entity markup; longer posts are sent as text
+// without the map.
+const telegramCaptionLimit = 1024
+
+var (
+	mapLandColor    = color.RGBA{0xee, 0xea, 0xdf, 0xff}
+	mapWaterColor   = color.RGBA{0xb5, 0xd3, 0xe7, 0xff}
+	mapPlaceColor   = color.RGBA{0x9a, 0x94, 0x88, 0xff}
+	mapCityColor    = color.RGBA{0x55, 0x50, 0x48, 0xff}
+	mapOutlineColor = color.RGBA{0xff, 0xff, 0xff, 0xff}
+)
+
+// threatColors tell the threat types apart on the map.
+var threatColors = map[string]color.RGBA{
+	threatShahed:        {0xf0, 0x8c, 0x00, 0xff},
+	threatCruiseMissile: {0xd7, 0x26, 0x1e, 0xff},
+	threatBallistic:     {0x8e, 0x24, 0xaa, 0xff},
+	threatAviation:      {0x1e, 0x5a, 0xc8, 0xff},
+	threatOther:         {0x33, 0x33, 0x33, 0xff},
+}
+
+// headingVectors are unit vectors of the compass headings in image coordinates, y pointing down.
+var headingVectors = map[string][2]float64{
+	"N":  {0, -1},
+	"NE": {math.Sqrt2 / 2, -math.Sqrt2 / 2},
+	"E":  {1, 0},
+	"SE": {math.Sqrt2 / 2, math.Sqrt2 / 2},
+	"S":  {0, 1},
+	"SW": {-math.Sqrt2 / 2, math.Sqrt2 / 2},
+	"W":  {-1, 0},
+	"NW": {-math.Sqrt2 / 2, -math.Sqrt2 / 2},
+}
+
+type baseMapPolygon struct {
+	Name   string       `json:"name"`
+	Points [][2]float64 `json:"points"`
+}
+
+type baseMap struct {
+	North float64          `json:"north"`
+	South float64          `json:"south"`
+	West  float64          `json:"west"`
+	East  float64          `json:"east"`
+	Water []baseMapPolygon `json:"water"`
+}
+
+// ThreatMap renders reported threats over the base map. A nil map renders nothing.
+type ThreatMap struct {
+	bounds    baseMap
+	base      *image.RGBA
+	gazetteer *Gazetteer
+}
+
+// point is a position in image pixels.
+type point struct{ X, Y float64 }
+
+// loadThreatMap draws the base map THREAT_MAP_WIDTH pixels wide. THREAT_MAP_ENABLED=false disables maps.
+func loadThreatMap(gazetteer *Gazetteer) (*ThreatMap, error) {
+	if getEnv("THREAT_MAP_ENABLED", "true") == "false" {
+		return nil, nil
+	}
+	var bounds baseMap
+	if err := json.Unmarshal(baseMapData, &bounds); err != nil {
+		return nil, fmt.Errorf("error parsing base map: %v", err)
+	}
+	if bounds.North <= bounds.South || bounds.East <= bounds.West {
+		return nil, fmt.Errorf("base map has empty bounds")
+	}
+
+	width := envInt("THREAT_MAP_WIDTH", 800)
+	if width < 200 || width > 2560 {
+		log.Printf("Invalid THREAT_MAP_WIDTH %d, using 800", width)
+		width = 800
+	}
+	// Equirectangular projection, longitude scaled for the latitude of Odesa
+	midLat := (bounds.North + bounds.South) / 2 * math.Pi / 180
+	height := int(float64(width) * (bounds.North - bounds.South) / ((bounds.East - bounds.West) * math.Cos(midLat)))
+
+	m := &ThreatMap{bounds: bounds, gazetteer: gazetteer, base: image.NewRGBA(image.Rect(0, 0, width, height))}
+	draw.Draw(m.base, m.base.Bounds(), image.NewUniform(mapLandColor), image.Point{}, draw.Src)
+	for _, water := range bounds.Water {
+		polygon := make([]point, len(water.Points))
+		for i, p := range water.Points {
+			polygon[i] = m.project(p[0], p[1])
+		}
+		fillPolygon(m.base, polygon, mapWaterColor)
+	}
+	// Known places give the markers a frame of reference
+	for _, location := range gazetteer.Locations() {
+		if location.Lat == 0 && location.Lon == 0 {
+			continue
+		}
+		switch location.Kind {
+		case "city":
+			fillCircle(m.base, m.project(location.Lat, location.Lon), m.scale(6), mapCityColor)
+		case "settlement", "neighbourhood":
+			fillCircle(m.base, m.project(location.Lat, location.Lon), m.scale(3), mapPlaceColor)
+		}
+	}
+
+	log.Printf("Threat map enabled: %dx%d", width, height)
+	return m, nil
+}
+
+// project converts coordinates to image pixels.
+func (m *ThreatMap) project(lat, lon float64) point {
+	size := m.base.Bounds().Size()
+	return point{
+		X: (lon - m.bounds.West) / (m.bounds.East - m.bounds.West) * float64(size.X),
+		Y: (m.bounds.North - lat) / (m.bounds.North - m.bounds.South) * float64(size.Y),
+	}
+}
+
+// scale sizes drawing elements relative to an 800 pixel wide map.
+func (m *ThreatMap) scale(pixels float64) float64 {
+	return pixels * float64(m.base.Bounds().Dx()) / 800
+}
+
+// Render draws a marker for every known location of the threats and an arrow
+// along every known heading; a heading without locations points at the city.
+// It returns a PNG, or nil when the threats give nothing to draw.
+func (m *ThreatMap) Render(threats []ThreatReport) ([]byte, error) {
+	if m == nil {
+		return nil, nil
+	}
+	img := image.NewRGBA(m.base.Bounds())
+	copy(img.Pix, m.base.Pix)
+
+	center, hasCenter := m.cityCenter()
+	arrowLength := m.scale(90)
+	drawn := false
+	for _, threat := range threats {
+		threatColor, ok := threatColors[threat.Type]
+		if !ok {
+			threatColor = threatColors[threatOther]
+		}
+		heading, hasHeading := headingVectors[threat.Heading]
+
+		var positions []point
+		for _, name := range threat.Districts {
+			location, ok := m.gazetteer.Resolve(name)
+			if ok && (location.Lat != 0 || location.Lon != 0) {
+				positions = append(positions, m.project(location.Lat, location.Lon))
+			}
+		}
+		if len(positions) == 0 && hasHeading && hasCenter {
+			// Only the course is known, show it arriving at the city
+			from := point{center.X - heading[0]*arrowLength*1.5, center.Y - heading[1]*arrowLength*1.5}
+			drawArrow(img, from, center, m.scale(5), threatColor)
+			drawn = true
+			continue
+		}
+		for _, position := range positions {
+			if hasHeading {
+				to := point{position.X + heading[0]*arrowLength, position.Y + heading[1]*arrowLength}
+				drawArrow(img, position, to, m.scale(5), threatColor)
+			}
+			fillCircle(img, position, m.scale(12), mapOutlineColor)
+			fillCircle(img, position, m.scale(9), threatColor)
+			drawn = true
+		}
+	}
+	if !drawn {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("error encoding threat map: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *ThreatMap) cityCenter() (point, bool) {
+	for _, location := range m.gazetteer.Locations() {
+		if location.Kind == "city" {
+			return m.project(location.Lat, location.Lon), true
+		}
+	}
+	return point{}, false
+}
+
+// fillPolygon fills the polygon with the even-odd rule, one scanline per pixel row.
+func fillPolygon(img *image.RGBA, polygon []point, c color.RGBA) {
+	bounds := img.Bounds()
+	var crossings []float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		scanY := float64(y) + 0.5
+		crossings = crossings[:0]
+		for i := range polygon {
+			a, b := polygon[i], polygon[(i+1)%len(polygon)]
+			if (a.Y <= scanY) == (b.Y <= scanY) {
+				continue
+			}
+			crossings = append(crossings, a.X+(scanY-a.Y)/(b.Y-a.Y)*(b.X-a.X))
+		}
+		slices.Sort(crossings)
+		for i := 0; i+1 < len(crossings); i += 2 {
+			from := max(int(math.Round(crossings[i])), bounds.Min.X)
+			to := min(int(math.Round(crossings[i+1])), bounds.Max.X)
+			for x := from; x < to; x++ {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
+
+func fillCircle(img *image.RGBA, center point, radius float64, c color.RGBA) {
+	bounds := img.Bounds()
+	for y := max(int(center.Y-radius), bounds.Min.Y); y <= min(int(center.Y+radius), bounds.Max.Y-1); y++ {
+		for x := max(int(center.X-radius), bounds.Min.X); x <= min(int(center.X+radius), bounds.Max.X-1); x++ {
+			dx, dy := float64(x)+0.5-center.X, float64(y)+0.5-center.Y
+			if dx*dx+dy*dy <= radius*radius {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
+
+// drawArrow draws a line of the given width from one point to another with a head at the end.
+func drawArrow(img *image.RGBA, from, to point, width float64, c color.RGBA) {
+	dx, dy := to.X-from.X, to.Y-from.Y
+	length := math.Hypot(dx, dy)
+	if length == 0 {
+		return
+	}
+	ux, uy := dx/length, dy/length
+	headLength := width * 4
+	shaftEnd := point{to.X - ux*headLength, to.Y - uy*headLength}
+	for step := 0.0; step <= length-headLength; step += width / 4 {
+		fillCircle(img, point{from.X + ux*step, from.Y + uy*step}, width/2, c)
+	}
+	// The head is a triangle whose base is perpendicular to the shaft
+	halfBase := width * 2
+	fillPolygon(img, []point{
+		to,
+		{shaftEnd.X - uy*halfBase, shaftEnd.Y + ux*halfBase},
+		{shaftEnd.X + uy*halfBase, shaftEnd.Y - ux*halfBase},
+	}, c)
+}
+
+// utf16Length is the length of the text in UTF-16 code units, as Telegram counts
+// it; characters outside the Basic Multilingual Plane, such as most emoji, take two.
+func utf16Length(text string) int {
+	length := 0
+	for _, r := range text {
+		if r >= 0x10000 {
+			length += 2
+		} else {
+			length++
+		}
+	}
+	return length
+}
+
+// sendPhotoToTelegram posts a PNG with the caption to the channel.
+func sendPhotoToTelegram(ctx context.Context, api *tg.Client, channelUsername string, caption FormattedText, photo []byte, silent bool) error {
+	channel, err := resolveChannel(ctx, api, channelUsername)
+	if err != nil {
+		return err
+	}
+	file, err := uploader.NewUploader(api).FromBytes(ctx, "threat_map.png", photo)
+	if err != nil {
+		return fmt.Errorf("failed to upload threat map: %v", err)
+	}
+	_, err = api.MessagesSendMedia(ctx, &tg.MessagesSendMediaRequest{
+		Peer:     channel.AsInputPeer(),
+		Media:    &tg.InputMediaUploadedPhoto{File: file},
+		Message:  caption.Text,
+		Entities: caption.Entities,
+		RandomID: rand.Int63(),
+		Silent:   silent,
+	})
+	return err
+}
+
+// sendResponse posts the formatted response to the channel, with a threat map
+// when one can be drawn. A map that cannot be rendered or sent falls back to the
+// text post.
+func sendResponse(ctx context.Context, api *tg.Client, channelUsername string, threatMap *ThreatMap, response AIJSONResponse, formatted FormattedText) error {
+	silent := !response.Danger
+	if response.Danger && utf16Length(formatted.Text) <= telegramCaptionLimit {
+		photo, err := threatMap.Render(response.Threats)
+		if err != nil {
+			log.Printf("Error rendering threat map: %v", err)
+		}
+		if photo != nil {
+			err = sendPhotoToTelegram(ctx, api, channelUsername, formatted, photo, silent)
+			if err == nil {
+				return nil
+			}
+			log.Printf("Error sending threat map, sending text only: %v", err)
+		}
+	}
+	return sendToTelegram(ctx, api, channelUsername, formatted.Text, formatted.Entities, silent)
+}
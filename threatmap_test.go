@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestUTF16Length(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"Odesa", 5},
+		{"Одеса", 5},
+		{"🚨 Шахеди", 9},
+		{"🚨🚀", 4},
+		{"⚠️", 2},
+	}
+	for _, tt := range tests {
+		if got := utf16Length(tt.text); got != tt.want {
+			t.Errorf("utf16Length(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+
+	// Emoji-heavy captions can pass a rune count and still exceed the limit
+	caption := strings.Repeat("🚨", 600)
+	if utf16Length(caption) <= telegramCaptionLimit {
+		t.Fatalf("%d emoji should exceed the caption limit", 600)
+	}
+}
+
+func TestThreatMapRender(t *testing.T) {
+	t.Setenv("THREAT_MAP_ENABLED", "")
+	t.Setenv("THREAT_MAP_WIDTH", "400")
+	threatMap, err := loadThreatMap(bundledGazetteer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		threats  []ThreatReport
+		wantDraw bool
+	}{
+		{"no threats", nil, false},
+		{"unknown place and heading", []ThreatReport{{Type: threatShahed, Heading: headingUnknown, Districts: []string{"Марс"}}}, false},
+		{"known place", []ThreatReport{{Type: threatShahed, Heading: "N", Districts: []string{"Затока"}}}, true},
+		{"heading only", []ThreatReport{{Type: threatBallistic, Heading: "E"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			photo, err := threatMap.Render(tt.threats)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (photo != nil) != tt.wantDraw {
+				t.Fatalf("rendered %v, want %v", photo != nil, tt.wantDraw)
+			}
+			if photo == nil {
+				return
+			}
+			img, err := png.Decode(bytes.NewReader(photo))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds().Dx() != 400 {
+				t.Fatalf("map is %d pixels wide, want 400", img.Bounds().Dx())
+			}
+		})
+	}
+
+	var nilMap *ThreatMap
+	if photo, err := nilMap.Render([]ThreatReport{{Type: threatShahed, Heading: "N"}}); photo != nil || err != nil {
+		t.Fatal("a disabled map must render nothing")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Threat types of ThreatReport.Type
+const (
+	threatShahed        = "shahed"
+	threatCruiseMissile = "cruise_missile"
+	threatBallistic     = "ballistic"
+	threatAviation      = "aviation"
+	threatOther         = "other"
+)
+
+// headingUnknown is used when the course of a threat is not reported
+const headingUnknown = "unknown"
+
+var (
+	threatTypes = []string{threatShahed, threatCruiseMissile, threatBallistic, threatAviation, threatOther}
+	headings    = []string{"N", "NE", "E", "SE", "S", "SW", "W", "NW", headingUnknown}
+)
+
+// schemaEnums holds the value lists referenced by enum tags, so the schema and
+// the validation share one definition.
+var schemaEnums = map[string][]string{
+	"threatType": threatTypes,
+	"heading":    headings,
+}
+
+// ThreatReport is one threat in a structured AI response.
+type ThreatReport struct {
+	Type      string   `json:"type" enum:"threatType" desc:"Kind of threat"`
+	Count     *int     `json:"count" desc:"Number of targets, null when not reported"`
+	Heading   string   `json:"heading" enum:"heading" desc:"Compass direction the threat is moving to, unknown when not reported"`
+	Districts []string `json:"districts" desc:"Odesa districts or nearby settlements on the threat's path, empty when unknown"`
+}
+
+// threatLabels are the post labels of the threat types.
+var threatLabels = map[string]string{
+	threatShahed:        "🛵 Шахеди",
+	threatCruiseMissile: "🚀 Крилаті ракети",
+	threatBallistic:     "☄️ Балістика",
+	threatAviation:      "✈️ Авіація",
+	threatOther:         "⚠️ Загроза",
+}
+
+// headingLabels describe the course in posts.
+var headingLabels = map[string]string{
+	"N":  "курс на північ",
+	"NE": "курс на північний схід",
+	"E":  "курс на схід",
+	"SE": "курс на південний схід",
+	"S":  "курс на південь",
+	"SW": "курс на південний захід",
+	"W":  "курс на захід",
+	"NW": "курс на північний захід",
+}
+
+// formatThreat renders a threat as one post line, e.g.
+// "🛵 Шахеди ×3, курс на північ: Пересипський р-н".
+func formatThreat(threat ThreatReport) string {
+	label, ok := threatLabels[threat.Type]
+	if !ok {
+		label = threatLabels[threatOther]
+	}
+	var b strings.Builder
+	b.WriteString(label)
+	if threat.Count != nil && *threat.Count > 0 {
+		fmt.Fprintf(&b, " ×%d", *threat.Count)
+	}
+	if heading, ok := headingLabels[threat.Heading]; ok {
+		b.WriteString(", " + heading)
+	}
+	if len(threat.Districts) > 0 {
+		b.WriteString(": " + strings.Join(threat.Districts, ", "))
+	}
+	return b.String()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"unicode/utf8"
+)
+
+// Token estimation constants. The numbers are approximations of each provider's
+// documented accounting; they only need to be close enough to keep requests
+// within budget, not to match invoices.
+const (
+	// messageOverheadTokens covers role markers and separators of a single message
+	messageOverheadTokens = 4
+	// unknownImageTokens is used when the image dimensions cannot be read
+	unknownImageTokens = 1000
+)
+
+// estimateMessageTokens estimates how many tokens a message costs for the given provider.
+func estimateMessageTokens(msg Message, provider string) int {
+	tokens := messageOverheadTokens + estimateTextTokens(msg.Content)
+	for _, img := range msg.Images {
+		tokens += estimateImageTokens(img, provider)
+	}
+	return tokens
+}
+
+// estimateTextTokens approximates tokenizer output: Latin text averages about four
+// characters per token, Cyrillic text closer to two.
+func estimateTextTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return int(math.Ceil(float64(ascii)/4 + float64(other)/2))
+}
+
+// estimateImageTokens applies the image accounting rules of the provider family.
+func estimateImageTokens(img Image, provider string) int {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(img.Data))
+	if err != nil || cfg.Width == 0 || cfg.Height == 0 {
+		return unknownImageTokens
+	}
+	width, height := float64(cfg.Width), float64(cfg.Height)
+
+	switch provider {
+	case "claude":
+		// Anthropic: images are scaled to a 1568px long edge, then cost width*height/750
+		if scale := 1568 / math.Max(width, height); scale < 1 {
+			width, height = width*scale, height*scale
+		}
+		return int(math.Ceil(width * height / 750))
+	case "gemini":
+		// Gemini: small images cost a flat 258 tokens, larger ones 258 per 768px tile
+		if width <= 384 && height <= 384 {
+			return 258
+		}
+		return int(math.Ceil(width/768)*math.Ceil(height/768)) * 258
+	default:
+		// OpenAI-compatible high detail: fit into 2048px, shortest side to 768px, 170 per 512px tile plus 85
+		if scale := 2048 / math.Max(width, height); scale < 1 {
+			width, height = width*scale, height*scale
+		}
+		if scale := 768 / math.Min(width, height); scale < 1 {
+			width, height = width*scale, height*scale
+		}
+		return 85 + 170*int(math.Ceil(width/512)*math.Ceil(height/512))
+	}
+}
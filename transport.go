@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls timeouts and retries of AI provider requests.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one
+	MaxAttempts int
+	// MaxMalformedRetries caps retries caused by unparseable responses, which rarely fix themselves
+	MaxMalformedRetries int
+	// RequestTimeout bounds a single attempt
+	RequestTimeout time.Duration
+	// BaseDelay is the backoff before the first retry, doubled on every further retry
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff and any Retry-After requested by the server
+	MaxDelay time.Duration
+}
+
+// APIError is returned when a provider answers with a non-2xx status.
+type APIError struct {
+	Provider   string
+	StatusCode int
+	// Type is the provider's error type when the body names one, e.g. overloaded_error
+	Type string
+	// RetryAfter is the delay requested by the server, zero when not given
+	RetryAfter time.Duration
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	if e.Type != "" {
+		return fmt.Sprintf("%s API request failed with status %d (%s): %s", e.Provider, e.StatusCode, e.Type, e.Body)
+	}
+	return fmt.Sprintf("%s API request failed with status %d: %s", e.Provider, e.StatusCode, e.Body)
+}
+
+// MalformedResponseError marks a response that arrived but could not be parsed.
+type MalformedResponseError struct {
+	Err error
+}
+
+func (e *MalformedResponseError) Error() string {
+	return "malformed response: " + e.Err.Error()
+}
+
+func (e *MalformedResponseError) Unwrap() error {
+	return e.Err
+}
+
+// malformed wraps a parse error so the retry policy can tell it apart.
+func malformed(err error) error {
+	return &MalformedResponseError{Err: err}
+}
+
+func loadRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:         envInt("AI_MAX_ATTEMPTS", 4),
+		MaxMalformedRetries: envInt("AI_MALFORMED_RETRIES", 1),
+		RequestTimeout:      envDuration("AI_REQUEST_TIMEOUT", 90*time.Second),
+		BaseDelay:           envDuration("AI_RETRY_BASE_DELAY", 2*time.Second),
+		MaxDelay:            envDuration("AI_RETRY_MAX_DELAY", 30*time.Second),
+	}
+}
+
+// envDuration reads a duration env value, logging and falling back to the default when it is invalid.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	raw := getEnv(key, "")
+	if raw == "" {
+		return fallback
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("Invalid %s duration '%s', using default %v: %v", key, raw, fallback, err)
+		return fallback
+	}
+	return value
+}
+
+// newAIHTTPClient returns the HTTP client shared by the AI providers. The client
+// timeout is a backstop; RetryPolicy.Do also bounds every attempt through ctx.
+func newAIHTTPClient(policy RetryPolicy) *http.Client {
+	return &http.Client{Timeout: policy.RequestTimeout}
+}
+
+// postJSON sends a JSON body and returns the response body. Non-2xx responses
+// are returned as *APIError including any Retry-After hint.
+func postJSON(ctx context.Context, client *http.Client, provider, url string, headers map[string]string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request: %w", provider, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to %s: %w", provider, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response body: %w", provider, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &APIError{
+			Provider:   provider,
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header),
+			Body:       string(respBody),
+		}
+	}
+	return respBody, nil
+}
+
+// parseRetryAfter reads retry-after-ms or Retry-After (seconds or HTTP date).
+func parseRetryAfter(header http.Header) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("retry-after-ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// Do runs attempt until it succeeds, fails with a non-retryable error, the
+// attempts are exhausted or ctx is cancelled. Every attempt gets its own timeout.
+func (p RetryPolicy) Do(ctx context.Context, provider string, attempt func(ctx context.Context) error) error {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var err error
+	malformedRetries := 0
+	for i := 1; i <= maxAttempts; i++ {
+		err = p.runAttempt(ctx, attempt)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		delay, retry := p.classify(err, i)
+		var malformedErr *MalformedResponseError
+		if errors.As(err, &malformedErr) {
+			malformedRetries++
+			retry = malformedRetries <= p.MaxMalformedRetries
+		}
+		if !retry || i == maxAttempts {
+			break
+		}
+
+		log.Printf("%s request failed (attempt %d/%d), retrying in %v: %v", provider, i, maxAttempts, delay.Round(time.Millisecond), err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return err
+}
+
+func (p RetryPolicy) runAttempt(ctx context.Context, attempt func(ctx context.Context) error) error {
+	if p.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.RequestTimeout)
+		defer cancel()
+	}
+	return attempt(ctx)
+}
+
+// classify decides whether err is worth retrying and how long to wait first.
+func (p RetryPolicy) classify(err error, attempt int) (time.Duration, bool) {
+	backoff := p.backoff(attempt)
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == http.StatusTooManyRequests:
+			// Rate limited: honour the server's hint, it knows when the window resets
+			if apiErr.RetryAfter > backoff {
+				backoff = apiErr.RetryAfter
+			}
+			return p.capDelay(backoff), true
+		case apiErr.StatusCode == http.StatusRequestTimeout, apiErr.StatusCode >= 500:
+			return backoff, true
+		default:
+			// Other 4xx errors (bad request, auth) will fail the same way again
+			return 0, false
+		}
+	}
+
+	var malformedErr *MalformedResponseError
+	if errors.As(err, &malformedErr) {
+		// The model produced garbage; retry right away with a short pause
+		return p.capDelay(p.BaseDelay / 2), true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return backoff, true
+	}
+	return 0, false
+}
+
+// backoff returns an exponential delay with jitter for the given attempt number.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	// Equal jitter: keep half of the delay, randomize the other half
+	half := delay / 2
+	if half > 0 {
+		delay = half + time.Duration(rand.Int63n(int64(half)))
+	}
+	return delay
+}
+
+func (p RetryPolicy) capDelay(delay time.Duration) time.Duration {
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyClassify(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: 5 * time.Second}
+	tests := []struct {
+		name      string
+		err       error
+		wantRetry bool
+		minDelay  time.Duration
+		maxDelay  time.Duration
+	}{
+		{"rate limited", &APIError{StatusCode: 429}, true, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"rate limited with retry after", &APIError{StatusCode: 429, RetryAfter: 2 * time.Second}, true, 2 * time.Second, 2 * time.Second},
+		{"retry after above the cap", &APIError{StatusCode: 429, RetryAfter: time.Minute}, true, 5 * time.Second, 5 * time.Second},
+		{"request timeout", &APIError{StatusCode: 408}, true, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"server error", &APIError{StatusCode: 503}, true, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"wrapped overloaded", fmt.Errorf("claude: %w", &APIError{StatusCode: 529, Type: "overloaded_error"}), true, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"bad request", &APIError{StatusCode: 400}, false, 0, 0},
+		{"unauthorized", &APIError{StatusCode: 401}, false, 0, 0},
+		{"malformed", malformed(errors.New("bad JSON")), true, 50 * time.Millisecond, 50 * time.Millisecond},
+		{"network", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"cut off body", fmt.Errorf("read body: %w", io.ErrUnexpectedEOF), true, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"attempt timeout", context.DeadlineExceeded, true, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"plain error", errors.New("no choices in response"), false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, retry := policy.classify(tt.err, 1)
+			if retry != tt.wantRetry {
+				t.Fatalf("retry = %v, want %v", retry, tt.wantRetry)
+			}
+			if delay < tt.minDelay || delay > tt.maxDelay {
+				t.Fatalf("delay = %v, want between %v and %v", delay, tt.minDelay, tt.maxDelay)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	tests := []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{10, 500 * time.Millisecond, time.Second},
+		// A shift past 64 bits must not wrap to zero
+		{80, 500 * time.Millisecond, time.Second},
+	}
+	for _, tt := range tests {
+		if delay := policy.backoff(tt.attempt); delay < tt.min || delay > tt.max {
+			t.Errorf("backoff(%d) = %v, want between %v and %v", tt.attempt, delay, tt.min, tt.max)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"none", http.Header{}, 0, 0},
+		{"seconds", http.Header{"Retry-After": {"3"}}, 3 * time.Second, 3 * time.Second},
+		{"milliseconds win", http.Header{"Retry-After": {"3"}, "Retry-After-Ms": {"250"}}, 250 * time.Millisecond, 250 * time.Millisecond},
+		{"http date", http.Header{"Retry-After": {time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)}}, 58 * time.Second, time.Minute},
+		{"date in the past", http.Header{"Retry-After": {time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)}}, 0, 0},
+		{"garbage", http.Header{"Retry-After": {"soon"}}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if delay := parseRetryAfter(tt.header); delay < tt.min || delay > tt.max {
+				t.Fatalf("parseRetryAfter = %v, want between %v and %v", delay, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 4, MaxMalformedRetries: 1, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	tests := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"success", nil, 1, false},
+		{"recovers after server errors", []error{&APIError{StatusCode: 502}, &APIError{StatusCode: 503}}, 3, false},
+		{"gives up after max attempts", []error{&APIError{StatusCode: 500}, &APIError{StatusCode: 500}, &APIError{StatusCode: 500}, &APIError{StatusCode: 500}, nil}, 4, true},
+		{"no retry on bad request", []error{&APIError{StatusCode: 400}, nil}, 1, true},
+		{"malformed retried once", []error{malformed(errors.New("a")), malformed(errors.New("b")), nil}, 2, true},
+		{"malformed cap counts only malformed", []error{malformed(errors.New("a")), &APIError{StatusCode: 500}, nil}, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := policy.Do(context.Background(), "test", func(ctx context.Context) error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Fatalf("%d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := policy.Do(ctx, "test", func(ctx context.Context) error { return ctx.Err() })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled Do = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pricesFile = "config/prices.json"
+	// defaultUsageFile keeps the daily totals across restarts; it stays out of the
+	// history directory, whose JSON files are all read as histories
+	defaultUsageFile = "config/usage.json"
+)
+
+// Budget actions applied once the daily budget is spent
+const (
+	// budgetActionFallback switches to the provider's fallback model, or text-only when none is set
+	budgetActionFallback = "fallback"
+	// budgetActionTextOnly keeps the model but stops sending images
+	budgetActionTextOnly = "text-only"
+)
+
+// TokenUsage is the token accounting of a single request. Cached, CacheWrite and
+// Image are subsets of Prompt; Image is informational and priced as prompt tokens.
+type TokenUsage struct {
+	Prompt     int `json:"prompt"`
+	Completion int `json:"completion"`
+	Cached     int `json:"cached"`
+	CacheWrite int `json:"cacheWrite"`
+	Image      int `json:"image"`
+}
+
+// ModelPrice is the price of a model in USD per million tokens. Cached and
+// CacheWrite default to the prompt price when zero.
+type ModelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+	Cached     float64 `json:"cached"`
+	CacheWrite float64 `json:"cacheWrite"`
+}
+
+// defaultPrices covers the built-in default models; config/prices.json overrides
+// and extends it. Keys are model names, or provider names as a catch-all.
+var defaultPrices = map[string]ModelPrice{
+	"o3-mini":                              {Prompt: 1.10, Completion: 4.40, Cached: 0.55},
+	"claude-3-opus-20240229":               {Prompt: 15, Completion: 75, Cached: 1.5, CacheWrite: 18.75},
+	"claude-sonnet-4-5":                    {Prompt: 3, Completion: 15, Cached: 0.3, CacheWrite: 3.75},
+	"deepseek-chat":                        {Prompt: 0.27, Completion: 1.10, Cached: 0.07},
+	"gemini-3-flash-preview":               {Prompt: 0.50, Completion: 3, Cached: 0.05},
+	"glm-5":                                {Prompt: 1, Completion: 3.20, Cached: 0.20},
+	"google/gemini-2.5-pro-exp-03-25:free": {},
+	"local":                                {},
+}
+
+// usageTotals accumulates usage and cost over a period.
+type usageTotals struct {
+	Requests int        `json:"requests"`
+	Usage    TokenUsage `json:"usage"`
+	Cost     float64    `json:"cost"`
+}
+
+// savedUsage is the content of the usage file.
+type savedUsage struct {
+	Day       string                  `json:"day"`
+	Today     usageTotals             `json:"today"`
+	Providers map[string]*usageTotals `json:"providers"`
+	// Alert is the running alert, nil when none is active
+	Alert *savedAlert `json:"alert,omitempty"`
+}
+
+// savedAlert is the usage of the running alert so far.
+type savedAlert struct {
+	Started time.Time   `json:"started"`
+	Totals  usageTotals `json:"totals"`
+}
+
+func (t *usageTotals) add(usage TokenUsage, cost float64) {
+	t.Requests++
+	t.Usage.Prompt += usage.Prompt
+	t.Usage.Completion += usage.Completion
+	t.Usage.Cached += usage.Cached
+	t.Usage.CacheWrite += usage.CacheWrite
+	t.Usage.Image += usage.Image
+	t.Cost += cost
+}
+
+func (t usageTotals) String() string {
+	return fmt.Sprintf("%d request(s), prompt %d (cached %d, image %d), completion %d, $%.4f",
+		t.Requests, t.Usage.Prompt, t.Usage.Cached, t.Usage.Image, t.Usage.Completion, t.Cost)
+}
+
+// UsageTracker records token usage of every provider, converts it to cost and
+// keeps daily and per-alert totals. It enforces the optional daily budget.
+// The daily totals and those of the running alert are saved to Path, so a
+// restart resets neither. A nil tracker records nothing.
+type UsageTracker struct {
+	// DailyBudget in USD, 0 disables the budget
+	DailyBudget  float64
+	BudgetAction string
+	// Location is the zone whose midnight starts a new budget day
+	Location *time.Location
+	// Path is the file the totals are saved to, empty to keep them in memory
+	Path string
+	// SaveInterval is how often changed totals are saved; day rolls and alert
+	// transitions are saved at once
+	SaveInterval time.Duration
+
+	mu            sync.Mutex
+	prices        map[string]ModelPrice
+	warnedModels  map[string]bool
+	day           string
+	dirty         bool
+	today         usageTotals
+	budgetLogged  bool
+	alertActive   bool
+	alertStarted  time.Time
+	alert         usageTotals
+	providerToday map[string]*usageTotals
+}
+
+func loadUsageTracker() *UsageTracker {
+	tracker := &UsageTracker{
+		DailyBudget:   envFloat("AI_DAILY_BUDGET_USD", 0),
+		BudgetAction:  strings.ToLower(getEnv("AI_BUDGET_ACTION", budgetActionFallback)),
+		Location:      promptLocation,
+		Path:          getEnv("AI_USAGE_FILE", defaultUsageFile),
+		SaveInterval:  envDuration("AI_USAGE_SAVE_INTERVAL", time.Minute),
+		prices:        make(map[string]ModelPrice),
+		warnedModels:  make(map[string]bool),
+		providerToday: make(map[string]*usageTotals),
+	}
+	if tracker.BudgetAction != budgetActionFallback && tracker.BudgetAction != budgetActionTextOnly {
+		log.Printf("Unknown AI_BUDGET_ACTION '%s', using %s", tracker.BudgetAction, budgetActionFallback)
+		tracker.BudgetAction = budgetActionFallback
+	}
+	for model, price := range defaultPrices {
+		tracker.prices[model] = price
+	}
+
+	path := getEnv("AI_PRICES_FILE", pricesFile)
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		log.Printf("Error reading price table: %v", err)
+	default:
+		var prices map[string]ModelPrice
+		if err := json.Unmarshal(data, &prices); err != nil {
+			log.Printf("Error parsing price table %s: %v", path, err)
+			break
+		}
+		for model, price := range prices {
+			tracker.prices[model] = price
+		}
+		log.Printf("Loaded %d price(s) from %s", len(prices), path)
+	}
+	tracker.restore()
+	return tracker
+}
+
+// currentDay is the budget day of now in t.Location.
+func (t *UsageTracker) currentDay() string {
+	location := t.Location
+	if location == nil {
+		location = time.Local
+	}
+	return time.Now().In(location).Format("2006-01-02")
+}
+
+// restore loads the saved daily totals when they are from today, and the totals
+// of an alert that was running when the bot stopped.
+func (t *UsageTracker) restore() {
+	if t.Path == "" {
+		return
+	}
+	data, err := os.ReadFile(t.Path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading usage file: %v", err)
+		return
+	}
+	var saved savedUsage
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Error parsing usage file %s: %v", t.Path, err)
+		return
+	}
+	if saved.Alert != nil {
+		t.alertActive = true
+		t.alertStarted = saved.Alert.Started
+		t.alert = saved.Alert.Totals
+		log.Printf("Restored usage for alert started %s: %s", t.alertStarted.Format(time.RFC3339), t.alert)
+	}
+	if saved.Day != t.currentDay() {
+		return
+	}
+	t.day = saved.Day
+	t.today = saved.Today
+	for provider, totals := range saved.Providers {
+		if totals != nil {
+			t.providerToday[provider] = totals
+		}
+	}
+	log.Printf("Restored usage for %s: %s", t.day, t.today)
+}
+
+// Start saves changed totals every SaveInterval until ctx is done, and once more then.
+func (t *UsageTracker) Start(ctx context.Context) {
+	if t == nil || t.Path == "" || t.SaveInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(t.SaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				t.flush()
+				return
+			case <-ticker.C:
+				t.flush()
+			}
+		}
+	}()
+}
+
+// flush saves the totals when they changed since the last save.
+func (t *UsageTracker) flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dirty {
+		t.save()
+	}
+}
+
+// save writes the totals to Path. Callers hold t.mu.
+func (t *UsageTracker) save() {
+	if t.Path == "" {
+		return
+	}
+	saved := savedUsage{Day: t.day, Today: t.today, Providers: t.providerToday}
+	if t.alertActive {
+		saved.Alert = &savedAlert{Started: t.alertStarted, Totals: t.alert}
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		log.Printf("Error encoding usage: %v", err)
+		return
+	}
+	if err := writeFileAtomic(t.Path, data); err != nil {
+		log.Printf("Error saving usage: %v", err)
+		return
+	}
+	t.dirty = false
+}
+
+// envFloat reads a float env value, logging and falling back to the default when it is invalid.
+func envFloat(key string, fallback float64) float64 {
+	raw := getEnv(key, "")
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Printf("Invalid %s value '%s', using default %g: %v", key, raw, fallback, err)
+		return fallback
+	}
+	return value
+}
+
+// cost converts usage to USD using the price of the model, or of the provider
+// when the model is not listed. Callers hold t.mu.
+func (t *UsageTracker) cost(provider, model string, usage TokenUsage) float64 {
+	price, ok := t.prices[model]
+	if !ok {
+		price, ok = t.prices[provider]
+	}
+	if !ok {
+		if !t.warnedModels[model] {
+			log.Printf("No price configured for %s model %s, counting it as free", provider, model)
+			t.warnedModels[model] = true
+		}
+		return 0
+	}
+	cached, cacheWrite := price.Cached, price.CacheWrite
+	if cached == 0 {
+		cached = price.Prompt
+	}
+	if cacheWrite == 0 {
+		cacheWrite = price.Prompt
+	}
+	uncached := usage.Prompt - usage.Cached - usage.CacheWrite
+	if uncached < 0 {
+		uncached = 0
+	}
+	return (float64(uncached)*price.Prompt +
+		float64(usage.Cached)*cached +
+		float64(usage.CacheWrite)*cacheWrite +
+		float64(usage.Completion)*price.Completion) / 1e6
+}
+
+// Record adds the usage of one request to the totals.
+func (t *UsageTracker) Record(provider, model string, usage TokenUsage) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rollDay()
+	cost := t.cost(provider, model, usage)
+	t.today.add(usage, cost)
+	if t.providerToday[provider] == nil {
+		t.providerToday[provider] = &usageTotals{}
+	}
+	t.providerToday[provider].add(usage, cost)
+	if t.alertActive {
+		t.alert.add(usage, cost)
+	}
+	t.dirty = true
+
+	log.Printf("Usage %s/%s: prompt %d (cached %d, image %d), completion %d, cost $%.4f; today $%.4f",
+		provider, model, usage.Prompt, usage.Cached, usage.Image, usage.Completion, cost, t.today.Cost)
+}
+
+// rollDay resets and saves the daily totals when the date changes. Callers hold t.mu.
+func (t *UsageTracker) rollDay() {
+	day := t.currentDay()
+	if day == t.day {
+		return
+	}
+	if t.day != "" {
+		log.Printf("Usage for %s: %s", t.day, t.today)
+		for provider, totals := range t.providerToday {
+			log.Printf("  %s: %s", provider, totals)
+		}
+	}
+	t.day = day
+	t.today = usageTotals{}
+	t.providerToday = make(map[string]*usageTotals)
+	t.budgetLogged = false
+	t.save()
+}
+
+// SelectModel returns the model to use for the next request and whether images
+// must be left out, applying the budget action once the daily budget is spent.
+func (t *UsageTracker) SelectModel(provider, model, fallbackModel string) (string, bool) {
+	if t == nil || t.DailyBudget <= 0 {
+		return model, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.rollDay()
+	if t.today.Cost < t.DailyBudget {
+		return model, false
+	}
+	if !t.budgetLogged {
+		log.Printf("Daily AI budget of $%.2f exceeded ($%.4f spent), applying budget action %s", t.DailyBudget, t.today.Cost, t.BudgetAction)
+		t.budgetLogged = true
+	}
+	if t.BudgetAction == budgetActionFallback && fallbackModel != "" {
+		return fallbackModel, false
+	}
+	return model, true
+}
+
+// StartAlert begins per-alert accounting. An alert restored from the usage file
+// keeps counting.
+func (t *UsageTracker) StartAlert() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.alertActive {
+		return
+	}
+	t.alertActive = true
+	t.alertStarted = time.Now()
+	t.alert = usageTotals{}
+	t.save()
+}
+
+// AlertActive reports whether an alert is being accounted, including one
+// restored from the usage file.
+func (t *UsageTracker) AlertActive() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.alertActive
+}
+
+// EndAlert logs and saves the totals of the finished alert.
+func (t *UsageTracker) EndAlert() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.alertActive {
+		return
+	}
+	t.alertActive = false
+	log.Printf("Usage for alert started %s (%v): %s",
+		t.alertStarted.Format(time.RFC3339), time.Since(t.alertStarted).Round(time.Second), t.alert)
+	t.save()
+}
+
+// openAIUsage is the usage object of OpenAI-compatible APIs, including the
+// DeepSeek cache hit extension.
+type openAIUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	PromptCacheHitTokens int `json:"prompt_cache_hit_tokens"`
+}
+
+// tokenUsage converts the API usage. Image tokens are not reported by these APIs
+// and are estimated from the request history.
+func (u openAIUsage) tokenUsage(history []Message, provider string) TokenUsage {
+	cached := u.PromptTokensDetails.CachedTokens
+	if u.PromptCacheHitTokens > cached {
+		cached = u.PromptCacheHitTokens
+	}
+	return TokenUsage{
+		Prompt:     u.PromptTokens,
+		Completion: u.CompletionTokens,
+		Cached:     cached,
+		Image:      estimateHistoryImageTokens(history, provider),
+	}
+}
+
+// estimateHistoryImageTokens estimates the image tokens of a request.
+func estimateHistoryImageTokens(history []Message, provider string) int {
+	tokens := 0
+	for _, msg := range history {
+		for _, img := range msg.Images {
+			tokens += estimateImageTokens(img, provider)
+		}
+	}
+	return tokens
+}
+
+// withoutImages replaces images with placeholders, used in text-only budget mode.
+func withoutImages(history []Message) []Message {
+	stripped := make([]Message, len(history))
+	for i, msg := range history {
+		if len(msg.Images) > 0 {
+			msg.Content = fmt.Sprintf("%s\n[%d image(s) omitted]", msg.Content, len(msg.Images))
+			msg.Images = nil
+		}
+		stripped[i] = msg
+	}
+	return stripped
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestUsageTracker(path string) *UsageTracker {
+	tracker := &UsageTracker{
+		Path:          path,
+		prices:        make(map[string]ModelPrice),
+		warnedModels:  make(map[string]bool),
+		providerToday: make(map[string]*usageTotals),
+	}
+	for model, price := range defaultPrices {
+		tracker.prices[model] = price
+	}
+	return tracker
+}
+
+// Every default model must be priced, or the daily budget never triggers for it.
+func TestDefaultModelsArePriced(t *testing.T) {
+	for _, model := range []string{chatGPTModel, claudeModel, deepseekModel, geminiModel, glmModel, openRouterModel} {
+		if _, ok := defaultPrices[model]; !ok {
+			t.Errorf("default model %s has no price", model)
+		}
+	}
+}
+
+func TestUsageCost(t *testing.T) {
+	tracker := newTestUsageTracker("")
+	tracker.prices["priced"] = ModelPrice{Prompt: 2, Completion: 10, Cached: 0.5, CacheWrite: 2.5}
+	tracker.prices["provider"] = ModelPrice{Prompt: 1, Completion: 1}
+
+	tests := []struct {
+		name     string
+		provider string
+		model    string
+		usage    TokenUsage
+		want     float64
+	}{
+		{"prompt and completion", "x", "priced", TokenUsage{Prompt: 1e6, Completion: 1e6}, 12},
+		{"cached tokens at the cached price", "x", "priced", TokenUsage{Prompt: 1e6, Cached: 1e6}, 0.5},
+		{"cache writes at the write price", "x", "priced", TokenUsage{Prompt: 1e6, CacheWrite: 1e6}, 2.5},
+		{"provider price as catch-all", "provider", "unknown", TokenUsage{Prompt: 1e6, Completion: 1e6}, 2},
+		{"unpriced model is free", "x", "unknown", TokenUsage{Prompt: 1e6}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tracker.cost(tt.provider, tt.model, tt.usage); math.Abs(got-tt.want) > 1e-9 {
+				t.Fatalf("cost = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+// A restart on the same day keeps the spent budget.
+func TestUsageTrackerRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	tracker := newTestUsageTracker(path)
+	tracker.Record("claude", claudeModel, TokenUsage{Prompt: 1e6, Completion: 1e5})
+	tracker.flush()
+
+	restarted := newTestUsageTracker(path)
+	restarted.restore()
+	if restarted.today.Cost != tracker.today.Cost || restarted.today.Requests != 1 {
+		t.Fatalf("restored today = %+v, want %+v", restarted.today, tracker.today)
+	}
+	if restarted.providerToday["claude"] == nil || restarted.providerToday["claude"].Cost != tracker.today.Cost {
+		t.Fatalf("restored provider totals = %+v", restarted.providerToday)
+	}
+
+	restarted.DailyBudget = tracker.today.Cost / 2
+	if _, textOnly := restarted.SelectModel("claude", claudeModel, ""); !textOnly {
+		t.Fatal("restored spend does not count against the budget")
+	}
+}
+
+// Totals are saved by flush, not by every Record.
+func TestUsageTrackerFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	tracker := newTestUsageTracker(path)
+	tracker.rollDay()
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("the day roll was not saved: %v", err)
+	}
+
+	tracker.Record("claude", claudeModel, TokenUsage{Prompt: 1e6})
+	if after, _ := os.ReadFile(path); string(after) != string(before) {
+		t.Fatal("Record wrote the usage file")
+	}
+	tracker.flush()
+	if after, _ := os.ReadFile(path); string(after) == string(before) {
+		t.Fatal("flush did not save the recorded usage")
+	}
+}
+
+// An alert running across a restart keeps its totals and is ended normally.
+func TestUsageTrackerRestoreAlert(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	tracker := newTestUsageTracker(path)
+	tracker.StartAlert()
+	tracker.Record("claude", claudeModel, TokenUsage{Prompt: 1e6})
+	tracker.flush()
+
+	restarted := newTestUsageTracker(path)
+	restarted.restore()
+	if !restarted.AlertActive() || restarted.alert.Requests != 1 || !restarted.alertStarted.Equal(tracker.alertStarted) {
+		t.Fatalf("restored alert = %+v since %v", restarted.alert, restarted.alertStarted)
+	}
+	restarted.StartAlert()
+	restarted.Record("claude", claudeModel, TokenUsage{Prompt: 1e6})
+	if restarted.alert.Requests != 2 {
+		t.Fatalf("restored alert restarted its totals: %+v", restarted.alert)
+	}
+
+	restarted.EndAlert()
+	ended := newTestUsageTracker(path)
+	ended.restore()
+	if ended.AlertActive() {
+		t.Fatal("an ended alert was restored")
+	}
+}
+
+func TestUsageTrackerCurrentDay(t *testing.T) {
+	tracker := newTestUsageTracker("")
+	for _, zone := range []string{"UTC", "Europe/Kyiv", "Pacific/Kiritimati"} {
+		location, err := time.LoadLocation(zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tracker.Location = location
+		if got, want := tracker.currentDay(), time.Now().In(location).Format("2006-01-02"); got != want {
+			t.Errorf("day in %s = %s, want %s", zone, got, want)
+		}
+	}
+}
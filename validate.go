@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const bannedPhrasesFile = "config/banned_phrases.txt"
+
+// ValidationRules are the checks an AI response must pass before it can be published.
+type ValidationRules struct {
+	// MaxTextLength is the maximum length of Text in characters
+	MaxTextLength int
+	// MinDangerTextLength is the minimum length of Text when Danger is set
+	MinDangerTextLength int
+	// BannedPhrases must not appear in Text (case-insensitive)
+	BannedPhrases []string
+	// Gazetteer, when set, gives threat districts their canonical names
+	Gazetteer *Gazetteer
+	// DropUnknownLocations removes districts the gazetteer does not know instead of keeping them
+	DropUnknownLocations bool
+}
+
+// ValidationError lists every rule an AI response violated.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid AI response: " + strings.Join(e.Problems, "; ")
+}
+
+func loadValidationRules() ValidationRules {
+	rules := ValidationRules{
+		MaxTextLength:        envInt("AI_MAX_TEXT_LENGTH", 1000),
+		MinDangerTextLength:  envInt("AI_MIN_DANGER_TEXT_LENGTH", 10),
+		DropUnknownLocations: getEnv("AI_DROP_UNKNOWN_LOCATIONS", "") == "true",
+	}
+
+	phrases, err := readBannedPhrases(getEnv("AI_BANNED_PHRASES_FILE", bannedPhrasesFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading banned phrases: %v", err)
+		}
+	} else {
+		rules.BannedPhrases = phrases
+		log.Printf("Loaded %d banned phrase(s)", len(phrases))
+	}
+	return rules
+}
+
+// envInt reads an integer env value, logging and falling back to the default when it is invalid.
+func envInt(key string, fallback int) int {
+	raw := getEnv(key, "")
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Printf("Invalid %s value '%s', using default %d: %v", key, raw, fallback, err)
+		return fallback
+	}
+	return value
+}
+
+// readBannedPhrases reads one phrase per line, skipping blank lines and # comments.
+func readBannedPhrases(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var phrases []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		phrases = append(phrases, strings.ToLower(line))
+	}
+	return phrases, scanner.Err()
+}
+
+// Validate checks the response against the rules and returns a *ValidationError
+// describing every violation, or nil when the response can be published.
+func (r ValidationRules) Validate(resp AIJSONResponse) error {
+	var problems []string
+	text := strings.TrimSpace(resp.Text)
+	textLength := utf8.RuneCountInString(text)
+
+	if resp.StatusChanged && text == "" {
+		problems = append(problems, "statusChanged is true but text is empty")
+	}
+	if resp.Danger {
+		if textLength < r.MinDangerTextLength {
+			problems = append(problems, fmt.Sprintf("danger is true but text has only %d characters, describe the threat", textLength))
+		}
+		if strings.TrimSpace(resp.Principle) == "" {
+			problems = append(problems, "danger is true but principle is empty")
+		}
+	}
+	for i, threat := range resp.Threats {
+		if !slices.Contains(threatTypes, threat.Type) {
+			problems = append(problems, fmt.Sprintf("threat %d has unknown type %q, use one of %s", i+1, threat.Type, strings.Join(threatTypes, ", ")))
+		}
+		if !slices.Contains(headings, threat.Heading) {
+			problems = append(problems, fmt.Sprintf("threat %d has unknown heading %q, use one of %s", i+1, threat.Heading, strings.Join(headings, ", ")))
+		}
+		if threat.Count != nil && *threat.Count < 0 {
+			problems = append(problems, fmt.Sprintf("threat %d has a negative count", i+1))
+		}
+	}
+	if resp.Confidence != nil && (*resp.Confidence < 0 || *resp.Confidence > 1) {
+		problems = append(problems, fmt.Sprintf("confidence %g is outside 0..1", *resp.Confidence))
+	}
+	if r.MaxTextLength > 0 && textLength > r.MaxTextLength {
+		problems = append(problems, fmt.Sprintf("text is %d characters long, the limit is %d", textLength, r.MaxTextLength))
+	}
+
+	lowered := strings.ToLower(text)
+	for _, phrase := range r.BannedPhrases {
+		if strings.Contains(lowered, phrase) {
+			problems = append(problems, fmt.Sprintf("text contains banned phrase %q", phrase))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// validateWithRepair validates the response and, if it is invalid, asks the model
+// once to correct it. An error means the response must not be published. Responses
+// without a status change are never published and are not validated, so routine
+// answers do not cost a repair request. The repair exchange is removed from the
+// history afterwards, leaving the repaired answer in place of the rejected one.
+func validateWithRepair(ctx context.Context, aiClient AIClient, rules ValidationRules, resp AIJSONResponse) (AIJSONResponse, error) {
+	resp = rules.normalizeResponse(resp)
+	if !resp.StatusChanged {
+		return resp, nil
+	}
+	err := rules.Validate(resp)
+	if err == nil {
+		return resp, nil
+	}
+
+	log.Printf("AI response failed validation, requesting repair: %v", err)
+	repairRequest := Message{
+		Role: "user",
+		Content: fmt.Sprintf("Your previous response was rejected: %v. "+
+			"Answer again for the same situation with a corrected JSON object.", err),
+	}
+
+	repaired, sendErr := aiClient.SendMessage(ctx, repairRequest)
+	if forgetter, ok := aiClient.(repairForgetter); ok {
+		forgetter.ForgetRepair(repairRequest.Content)
+	}
+	if sendErr != nil {
+		return AIJSONResponse{}, fmt.Errorf("repair request failed: %w (original problem: %v)", sendErr, err)
+	}
+
+	repaired = rules.normalizeResponse(repaired)
+	if !repaired.StatusChanged {
+		log.Printf("AI response repaired to no status change")
+		return repaired, nil
+	}
+	if err := rules.Validate(repaired); err != nil {
+		return AIJSONResponse{}, fmt.Errorf("repaired response still invalid: %w", err)
+	}
+	log.Printf("AI response repaired successfully")
+	return repaired, nil
+}
+
+// normalizeResponse fixes harmless deviations before validation, mostly from
+// providers without schema enforcement: surrounding whitespace, letter case of
+// enum values, a missing heading, empty list entries and place name spellings.
+func (r ValidationRules) normalizeResponse(resp AIJSONResponse) AIJSONResponse {
+	resp.Text = strings.TrimSpace(resp.Text)
+	threats := make([]ThreatReport, 0, len(resp.Threats))
+	for _, threat := range resp.Threats {
+		threat.Type = strings.ToLower(strings.TrimSpace(threat.Type))
+		threat.Heading = strings.TrimSpace(threat.Heading)
+		if threat.Heading == "" || strings.EqualFold(threat.Heading, headingUnknown) {
+			threat.Heading = headingUnknown
+		} else {
+			threat.Heading = strings.ToUpper(threat.Heading)
+		}
+		threat.Districts = r.Gazetteer.checkLocations(compactStrings(threat.Districts), r.DropUnknownLocations)
+		threats = append(threats, threat)
+	}
+	resp.Threats = threats
+	resp.Sources = compactStrings(resp.Sources)
+	return resp
+}
+
+// compactStrings trims the values and drops empty ones.
+func compactStrings(values []string) []string {
+	var compacted []string
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			compacted = append(compacted, value)
+		}
+	}
+	return compacted
+}
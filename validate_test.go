@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// scriptedClient answers with the queued responses and records its history the
+// way the provider clients do.
+type scriptedClient struct {
+	answers []AIJSONResponse
+	history []Message
+	sent    int
+}
+
+func (c *scriptedClient) SendMessage(ctx context.Context, message Message) (AIJSONResponse, error) {
+	c.history = append(c.history, message)
+	answer := c.answers[c.sent]
+	c.sent++
+	c.history = append(c.history, Message{Role: "assistant", Content: answer.Text})
+	return answer, nil
+}
+
+func (c *scriptedClient) AddMessageToHistory(message Message) { c.history = append(c.history, message) }
+func (c *scriptedClient) GetMessageHistory() []Message        { return copyHistory(c.history) }
+func (c *scriptedClient) ForgetRepair(request string)         { c.history = withoutRepair(c.history, request) }
+
+func TestValidateWithRepair(t *testing.T) {
+	rules := ValidationRules{MaxTextLength: 1000, MinDangerTextLength: 10}
+	valid := AIJSONResponse{Text: "Шахеди над Одесою", Principle: "reported", Danger: true, StatusChanged: true}
+
+	tests := []struct {
+		name      string
+		response  AIJSONResponse
+		answers   []AIJSONResponse
+		wantSent  int
+		wantErr   bool
+		wantTexts []string
+	}{
+		{
+			name:      "unchanged status is not validated",
+			response:  AIJSONResponse{Text: "ще", Danger: true},
+			wantTexts: []string{"batch", "ще"},
+		},
+		{
+			name:      "valid change needs no repair",
+			response:  valid,
+			wantTexts: []string{"batch", valid.Text},
+		},
+		{
+			name:      "repaired answer replaces the rejected one",
+			response:  AIJSONResponse{Text: "ще", Danger: true, StatusChanged: true},
+			answers:   []AIJSONResponse{valid},
+			wantSent:  1,
+			wantTexts: []string{"batch", valid.Text},
+		},
+		{
+			name:      "still invalid after repair",
+			response:  AIJSONResponse{Text: "ще", Danger: true, StatusChanged: true},
+			answers:   []AIJSONResponse{{Text: "ні", Danger: true, StatusChanged: true}},
+			wantSent:  1,
+			wantErr:   true,
+			wantTexts: []string{"batch", "ні"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &scriptedClient{answers: tt.answers, history: []Message{
+				{Role: "user", Content: "batch"},
+				{Role: "assistant", Content: tt.response.Text},
+			}}
+			_, err := validateWithRepair(context.Background(), client, rules, tt.response)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if client.sent != tt.wantSent {
+				t.Fatalf("sent %d repair request(s), want %d", client.sent, tt.wantSent)
+			}
+			var texts []string
+			for _, message := range client.history {
+				texts = append(texts, message.Content)
+			}
+			if strings.Join(texts, "|") != strings.Join(tt.wantTexts, "|") {
+				t.Fatalf("history = %q, want %q", texts, tt.wantTexts)
+			}
+		})
+	}
+}
+
+func TestWithoutRepair(t *testing.T) {
+	const request = "Your previous response was rejected"
+	tests := []struct {
+		name    string
+		history []Message
+		want    []string
+	}{
+		{
+			name: "answered repair drops the rejected answer",
+			history: []Message{
+				{Role: "user", Content: "batch"}, {Role: "assistant", Content: "rejected"},
+				{Role: "user", Content: request}, {Role: "assistant", Content: "repaired"},
+			},
+			want: []string{"batch", "repaired"},
+		},
+		{
+			name: "unanswered repair keeps the rejected answer",
+			history: []Message{
+				{Role: "user", Content: "batch"}, {Role: "assistant", Content: "rejected"},
+				{Role: "user", Content: request},
+			},
+			want: []string{"batch", "rejected"},
+		},
+		{
+			name:    "no repair request",
+			history: []Message{{Role: "user", Content: "batch"}, {Role: "assistant", Content: "answer"}},
+			want:    []string{"batch", "answer"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := copyHistory(tt.history)
+			got := withoutRepair(tt.history, request)
+			var texts []string
+			for _, message := range got {
+				texts = append(texts, message.Content)
+			}
+			if strings.Join(texts, "|") != strings.Join(tt.want, "|") {
+				t.Fatalf("got %q, want %q", texts, tt.want)
+			}
+			for i := range original {
+				if tt.history[i].Content != original[i].Content {
+					t.Fatalf("input history modified at %d", i)
+				}
+			}
+		})
+	}
+}